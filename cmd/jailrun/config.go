@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/redpwn/jail/internal/cgroup"
+	"github.com/redpwn/jail/internal/config"
+	"github.com/redpwn/jail/internal/privs"
+	"github.com/redpwn/jail/internal/proto/nsjail"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+)
+
+const configUsage = "usage: jailrun config [-json]"
+
+// runConfig prints the nsjail config and seccomp allowlist that the jail would
+// start with, without mounting anything or running the hook.
+func runConfig(args []string) error {
+	asJson := false
+	switch {
+	case len(args) == 1 && args[0] == "-json":
+		asJson = true
+	case len(args) != 0:
+		return errors.New(configUsage)
+	}
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return err
+	}
+	cg, err := cgroup.ReadCgroup()
+	if err != nil {
+		return err
+	}
+	msg := &nsjail.NsJailConfig{}
+	if err := cfg.SetConfig(msg); err != nil {
+		return err
+	}
+	if err := cg.SetConfig(msg, true); err != nil {
+		return err
+	}
+	syscalls := privs.AllowedSyscalls(cfg)
+	if asJson {
+		nsjailJson, err := protojson.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Nsjail   json.RawMessage `json:"nsjail"`
+			Syscalls []string        `json:"syscalls"`
+		}{nsjailJson, syscalls})
+	}
+	content, err := prototext.MarshalOptions{Multiline: true}.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(content)
+	// comments, so the output is still a valid nsjail config
+	fmt.Println("\n# seccomp allowlist:")
+	for _, name := range syscalls {
+		fmt.Printf("#   %s\n", name)
+	}
+	return nil
+}
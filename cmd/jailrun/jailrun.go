@@ -12,12 +12,24 @@ import (
 )
 
 func run() error {
+	if len(os.Args) > 1 && os.Args[1] == "pow" {
+		return runPow(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		return runToken(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "overlay" {
+		return server.RunOverlay(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		return runConfig(os.Args[2:])
+	}
 	cfg, err := config.GetConfig()
 	if err != nil {
 		return err
 	}
 	if len(os.Args) > 1 && os.Args[1] == "proxy" {
-		return server.RunProxy(cfg)
+		return server.RunProxy(cfg, os.Args[2:])
 	}
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -35,7 +47,7 @@ func run() error {
 	if err := cfg.SetConfig(msg); err != nil {
 		return err
 	}
-	if err := cg.SetConfig(msg); err != nil {
+	if err := cg.SetConfig(msg, false); err != nil {
 		return err
 	}
 	if err := config.WriteConfig(msg); err != nil {
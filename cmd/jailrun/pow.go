@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redpwn/pow"
+)
+
+const powUsage = `usage:
+  jailrun pow gen <difficulty>
+  jailrun pow solve <challenge>
+  jailrun pow check <challenge> <solution>`
+
+func runPow(args []string) error {
+	if len(args) < 1 {
+		return errors.New(powUsage)
+	}
+	switch {
+	case args[0] == "gen" && len(args) == 2:
+		d, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("parse difficulty: %w", err)
+		}
+		fmt.Println(pow.GenerateChallenge(uint32(d)))
+		return nil
+	case args[0] == "solve" && len(args) == 2:
+		chall, err := pow.DecodeChallenge(args[1])
+		if err != nil {
+			return fmt.Errorf("decode challenge: %w", err)
+		}
+		start := time.Now()
+		fmt.Println(chall.Solve())
+		// stderr so the solution can be piped
+		fmt.Fprintf(os.Stderr, "solved in %s\n", time.Since(start).Round(time.Millisecond))
+		return nil
+	case args[0] == "check" && len(args) == 3:
+		chall, err := pow.DecodeChallenge(args[1])
+		if err != nil {
+			return fmt.Errorf("decode challenge: %w", err)
+		}
+		good, err := chall.Check(args[2])
+		if err != nil {
+			return fmt.Errorf("check solution: %w", err)
+		}
+		if !good {
+			return errors.New("incorrect solution")
+		}
+		fmt.Println("correct")
+		return nil
+	}
+	return errors.New(powUsage)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/redpwn/jail/internal/server"
+)
+
+const tokenUsage = "usage: JAIL_AUTH_SECRET=<secret> jailrun token <team>..."
+
+func runToken(args []string) error {
+	secret := os.Getenv("JAIL_AUTH_SECRET")
+	if secret == "" || len(args) < 1 {
+		return errors.New(tokenUsage)
+	}
+	for _, team := range args {
+		fmt.Println(server.AuthToken(secret, team))
+	}
+	return nil
+}
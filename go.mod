@@ -1,6 +1,6 @@
 module github.com/redpwn/jail
 
-go 1.19
+go 1.21
 
 require (
 	github.com/caarlos0/env/v6 v6.10.1
@@ -9,6 +9,7 @@ require (
 	github.com/seccomp/libseccomp-golang v0.10.0
 	golang.org/x/sys v0.10.0
 	google.golang.org/protobuf v1.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
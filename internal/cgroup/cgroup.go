@@ -13,11 +13,14 @@ import (
 
 type Cgroup interface {
 	Mount() error
-	SetConfig(*nsjail.NsJailConfig) error
+	// SetConfig sets the cgroup options of msg. If dryRun is true, the cgroups
+	// have not been mounted, so features are detected from hostPath instead.
+	SetConfig(msg *nsjail.NsJailConfig, dryRun bool) error
 }
 
 const (
 	rootPath   = "/jail/cgroup"
+	hostPath   = "/sys/fs/cgroup"
 	mountFlags = uintptr(unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_RELATIME)
 )
 
@@ -42,6 +45,7 @@ func Unshare() error {
 
 func ReadCgroup() (Cgroup, error) {
 	v1 := &cgroup1{}
+	v2 := &cgroup2{}
 	f, err := os.Open("/proc/self/cgroup")
 	if err != nil {
 		return nil, fmt.Errorf("read cgroup info: %w", err)
@@ -57,6 +61,8 @@ func ReadCgroup() (Cgroup, error) {
 			controllers: parts[1],
 		}
 		switch parts[1] {
+		case "":
+			v2.path = parts[2]
 		case "pids":
 			v1.pids = entry
 		case "memory":
@@ -66,7 +72,7 @@ func ReadCgroup() (Cgroup, error) {
 		}
 	}
 	if v1.pids == nil && v1.mem == nil && v1.cpu == nil {
-		return &cgroup2{}, nil
+		return v2, nil
 	}
 	return v1, nil
 }
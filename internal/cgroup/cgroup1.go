@@ -51,11 +51,16 @@ func (c *cgroup1) Mount() error {
 	return nil
 }
 
-func (c *cgroup1) SetConfig(msg *nsjail.NsJailConfig) error {
+func (c *cgroup1) SetConfig(msg *nsjail.NsJailConfig, dryRun bool) error {
 	msg.CgroupPidsMount = proto.String(rootPath + "/pids")
 	msg.CgroupMemMount = proto.String(rootPath + "/mem")
 	msg.CgroupCpuMount = proto.String(rootPath + "/cpu")
-	exists, err := checkExists(rootPath + "/mem/memory.memsw.limit_in_bytes")
+	// swap accounting applies to every memory cgroup, including the root
+	memPath := rootPath + "/mem"
+	if dryRun {
+		memPath = hostPath + "/memory"
+	}
+	exists, err := checkExists(memPath + "/memory.memsw.limit_in_bytes")
 	if err != nil {
 		return err
 	}
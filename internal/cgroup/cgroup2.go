@@ -10,7 +10,10 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-type cgroup2 struct{}
+type cgroup2 struct {
+	// path is the cgroup of this process, relative to hostPath
+	path string
+}
 
 func (c *cgroup2) Mount() error {
 	mountPath := rootPath + "/unified"
@@ -43,10 +46,16 @@ func (c *cgroup2) Mount() error {
 	return nil
 }
 
-func (c *cgroup2) SetConfig(msg *nsjail.NsJailConfig) error {
+func (c *cgroup2) SetConfig(msg *nsjail.NsJailConfig, dryRun bool) error {
 	msg.UseCgroupv2 = proto.Bool(true)
 	msg.Cgroupv2Mount = proto.String(rootPath + "/unified/run")
-	exists, err := checkExists(rootPath + "/unified/memory.swap.max")
+	// the root cgroup has no memory.swap.max, so check the cgroup that Mount
+	// would mount at rootPath/unified
+	cgPath := rootPath + "/unified"
+	if dryRun {
+		cgPath = hostPath + c.path
+	}
+	exists, err := checkExists(cgPath + "/memory.swap.max")
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ReadAuthTokens reads a file of team IDs and tokens, and returns the team ID
+// of each token.
+func ReadAuthTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read auth tokens: %w", err)
+	}
+	defer f.Close()
+	tokens := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("auth tokens line %d: expected team and token", line)
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read auth tokens: %w", err)
+	}
+	return tokens, nil
+}
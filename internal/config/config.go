@@ -26,24 +26,135 @@ func (s *size) UnmarshalText(t []byte) error {
 }
 
 type Config struct {
-	Time       uint32   `env:"JAIL_TIME" envDefault:"20"`
-	Conns      uint32   `env:"JAIL_CONNS"`
-	ConnsPerIp uint32   `env:"JAIL_CONNS_PER_IP"`
-	Pids       uint64   `env:"JAIL_PIDS" envDefault:"5"`
-	Mem        size     `env:"JAIL_MEM" envDefault:"5M"`
-	Cpu        uint32   `env:"JAIL_CPU" envDefault:"100"`
-	Pow        uint32   `env:"JAIL_POW"`
-	Port       uint32   `env:"JAIL_PORT" envDefault:"5000"`
-	Dev        []string `env:"JAIL_DEV" envDefault:"null,zero,urandom"`
-	Syscalls   []string `env:"JAIL_SYSCALLS"`
-	TmpSize    size     `env:"JAIL_TMP_SIZE"`
-	Env        []string
+	Time             uint32   `env:"JAIL_TIME" envDefault:"20"`
+	Conns            uint32   `env:"JAIL_CONNS"`
+	ConnsPerIp       uint32   `env:"JAIL_CONNS_PER_IP"`
+	ConnsPerTeam     uint32   `env:"JAIL_CONNS_PER_TEAM"`
+	Queue            uint32   `env:"JAIL_QUEUE"`
+	QueuePerIp       uint32   `env:"JAIL_QUEUE_PER_IP" envDefault:"1"`
+	QueueTime        uint32   `env:"JAIL_QUEUE_TIME" envDefault:"300"`
+	Ipv4Prefix       uint8    `env:"JAIL_IPV4_PREFIX" envDefault:"32"`
+	Ipv6Prefix       uint8    `env:"JAIL_IPV6_PREFIX" envDefault:"64"`
+	Pids             uint64   `env:"JAIL_PIDS" envDefault:"5"`
+	Mem              size     `env:"JAIL_MEM" envDefault:"5M"`
+	Cpu              uint32   `env:"JAIL_CPU" envDefault:"100"`
+	Pow              uint32   `env:"JAIL_POW"`
+	PowMax           uint32   `env:"JAIL_POW_MAX"`
+	PowAdapt         string   `env:"JAIL_POW_ADAPT"`
+	PowTimeout       uint32   `env:"JAIL_POW_TIMEOUT"`
+	PowFirst         bool     `env:"JAIL_POW_FIRST"`
+	PowPrompt        string   `env:"JAIL_POW_PROMPT"`
+	PowMachine       bool     `env:"JAIL_POW_MACHINE"`
+	Port             uint32   `env:"JAIL_PORT" envDefault:"5000"`
+	Mode             string   `env:"JAIL_MODE" envDefault:"listen"`
+	Dev              []string `env:"JAIL_DEV" envDefault:"null,zero,urandom"`
+	Syscalls         []string `env:"JAIL_SYSCALLS"`
+	FlagSecret       string   `env:"JAIL_FLAG_SECRET"`
+	FlagFormat       string   `env:"JAIL_FLAG_FORMAT" envDefault:"flag{%s}"`
+	FlagPath         string   `env:"JAIL_FLAG_PATH"`
+	FlagEnv          string   `env:"JAIL_FLAG_ENV"`
+	TmpSize          size     `env:"JAIL_TMP_SIZE"`
+	OverlaySize      size     `env:"JAIL_OVERLAY_SIZE"`
+	Mounts           []Mount  `env:"JAIL_MOUNTS" envSeparator:";"`
+	IdleTimeout      uint32   `env:"JAIL_IDLE_TIMEOUT"`
+	MaxBytesIn       size     `env:"JAIL_MAX_BYTES_IN"`
+	MaxBytesOut      size     `env:"JAIL_MAX_BYTES_OUT"`
+	Bandwidth        size     `env:"JAIL_BANDWIDTH"`
+	HalfCloseTimeout uint32   `env:"JAIL_HALF_CLOSE_TIMEOUT" envDefault:"60"`
+	RecordDir        string   `env:"JAIL_RECORD_DIR"`
+	RecordSize       size     `env:"JAIL_RECORD_SIZE" envDefault:"1M"`
+	RecordTotal      size     `env:"JAIL_RECORD_TOTAL"`
+	RecordAge        uint32   `env:"JAIL_RECORD_AGE"`
+	TlsCert          string   `env:"JAIL_TLS_CERT"`
+	TlsKey           string   `env:"JAIL_TLS_KEY"`
+	ProxyProto       bool     `env:"JAIL_PROXY_PROTOCOL"`
+	AuthTokens       string   `env:"JAIL_AUTH_TOKENS"`
+	AuthSecret       string   `env:"JAIL_AUTH_SECRET"`
+	Rate             uint32   `env:"JAIL_RATE"`
+	RateBurst        uint32   `env:"JAIL_RATE_BURST" envDefault:"5"`
+	RatePrefix       uint8    `env:"JAIL_RATE_IPV6_PREFIX"`
+	MetricsPort      uint32   `env:"JAIL_METRICS_PORT"`
+	LogFormat        string   `env:"JAIL_LOG_FORMAT" envDefault:"logfmt"`
+	DrainTimeout     uint32   `env:"JAIL_DRAIN_TIMEOUT" envDefault:"5"`
+	DrainMessage     string   `env:"JAIL_DRAIN_MESSAGE"`
+	Acl              bool
+	Env              []string
 }
 
 const envPrefix = "JAIL_ENV_"
 
+const (
+	AllowListPath = "/jail/allow.txt"
+	DenyListPath  = "/jail/deny.txt"
+	OverlayPath   = "/jail/overlay"
+)
+
+func (c *Config) Tls() bool {
+	return c.TlsCert != "" || c.TlsKey != ""
+}
+
+func (c *Config) Auth() bool {
+	return c.AuthTokens != "" || c.AuthSecret != ""
+}
+
+// Record reports whether session transcripts are recorded.
+func (c *Config) Record() bool {
+	return c.RecordDir != ""
+}
+
+// Once reports whether the proxy runs nsjail once for each connection
+// instead of forwarding connections to a listening nsjail.
+func (c *Config) Once() bool {
+	return c.OnceReason() != ""
+}
+
+// OnceReason returns the setting that makes the proxy use once mode, or an
+// empty string if nsjail listens for connections. Settings that need a jail
+// config for each session imply once mode.
+func (c *Config) OnceReason() string {
+	switch {
+	case c.Mode == "once":
+		return "JAIL_MODE"
+	case c.FlagSecret != "":
+		return "JAIL_FLAG_SECRET"
+	case c.Auth():
+		return "JAIL_AUTH_TOKENS or JAIL_AUTH_SECRET"
+	case c.Overlay():
+		return "JAIL_OVERLAY_SIZE"
+	}
+	return ""
+}
+
+// Overlay reports whether each jail has a writable overlay of /srv as its
+// root.
+func (c *Config) Overlay() bool {
+	return c.OverlaySize > 0
+}
+
+// PowEnabled reports whether connections may be asked for a proof of work.
+func (c *Config) PowEnabled() bool {
+	return c.Pow > 0 || (c.PowAdapt != "" && c.PowMax > 0)
+}
+
+// GroupsIps reports whether per-IP limits apply to prefixes larger than a
+// single address, which nsjail does not support.
+func (c *Config) GroupsIps() bool {
+	return c.ConnsPerIp > 0 && (c.Ipv4Prefix < 32 || c.Ipv6Prefix < 128)
+}
+
+// LimitsCopy reports whether limits on forwarded data are enabled.
+func (c *Config) LimitsCopy() bool {
+	return c.IdleTimeout > 0 || c.MaxBytesIn > 0 || c.MaxBytesOut > 0 || c.Bandwidth > 0
+}
+
+// needsProxy reports whether any enabled feature is implemented by the proxy
+// rather than nsjail.
+func (c *Config) needsProxy() bool {
+	return c.PowEnabled() || c.Auth() || c.Once() || c.Acl || c.Tls() || c.LimitsCopy() || c.Record() || c.ProxyProto || c.Rate > 0 || c.GroupsIps() || c.MetricsPort > 0 || c.Queue > 0
+}
+
 func (c *Config) NsjailListen() (uint32, bool) {
-	if c.Pow <= 0 {
+	if !c.needsProxy() {
 		return c.Port, false
 	}
 	return c.Port + 1, true
@@ -115,6 +226,9 @@ func (c *Config) SetConfig(msg *nsjail.NsJailConfig) error {
 			Nosuid:  proto.Bool(true),
 		})
 	}
+	for _, m := range c.Mounts {
+		msg.Mount = append(msg.Mount, m.mountPt())
+	}
 	msg.Envar = c.Env
 	return nil
 }
@@ -128,29 +242,61 @@ func mountTmp() error {
 	return nil
 }
 
-func WriteConfig(msg *nsjail.NsJailConfig) error {
-	if err := mountTmp(); err != nil {
-		return err
-	}
+// WriteConfigFile writes msg to path in the format nsjail reads.
+func WriteConfigFile(path string, msg *nsjail.NsJailConfig) error {
 	content, err := prototext.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(NsjailConfigPath, content, 0644); err != nil {
+	if err := os.WriteFile(path, content, 0644); err != nil {
 		return err
 	}
 	return nil
 }
 
+func WriteConfig(msg *nsjail.NsJailConfig) error {
+	if err := mountTmp(); err != nil {
+		return err
+	}
+	return WriteConfigFile(NsjailConfigPath, msg)
+}
+
+// ReadConfig reads the nsjail config written by WriteConfig, including any
+// changes made by the hook.
+func ReadConfig() (*nsjail.NsJailConfig, error) {
+	content, err := os.ReadFile(NsjailConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	msg := &nsjail.NsJailConfig{}
+	if err := prototext.Unmarshal(content, msg); err != nil {
+		return nil, fmt.Errorf("parse nsjail config: %w", err)
+	}
+	return msg, nil
+}
+
 func GetConfig() (*Config, error) {
 	cfg := &Config{}
 	if err := env.Parse(cfg); err != nil {
 		return nil, fmt.Errorf("parse env config: %w", err)
 	}
+	if err := readConfigFile(cfg); err != nil {
+		return nil, err
+	}
+	for _, path := range []string{AllowListPath, DenyListPath} {
+		exists, err := checkExists(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Acl = cfg.Acl || exists
+	}
 	for _, e := range os.Environ() {
 		if strings.HasPrefix(e, envPrefix) {
 			cfg.Env = append(cfg.Env, strings.TrimPrefix(e, envPrefix))
 		}
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const ConfigFilePath = "/jail/jail.yaml"
+
+// fileEnvKey is the file section for environment variables, which are
+// otherwise set with JAIL_ENV_ variables.
+const fileEnvKey = "env"
+
+// fileKey returns the config file key for an env variable name, which is the
+// name without JAIL_ in lowercase.
+func fileKey(name string) string {
+	return strings.ToLower(strings.TrimPrefix(name, "JAIL_"))
+}
+
+// fileFields returns the fields of cfg that can be set in the config file,
+// by key.
+func fileFields(cfg *Config) map[string]reflect.Value {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < t.NumField(); i++ {
+		if name, ok := t.Field(i).Tag.Lookup("env"); ok {
+			fields[fileKey(name)] = v.Field(i)
+		}
+	}
+	return fields
+}
+
+// keyError returns an error for a config file key, with the yaml errors for
+// the key on one line.
+func keyError(key string, err error) error {
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		err = errors.New(strings.Join(typeErr.Errors, "; "))
+	}
+	return fmt.Errorf("config file key %q: %w", key, err)
+}
+
+type fileEntry struct {
+	key  string
+	node yaml.Node
+}
+
+// readConfigFile sets the fields of cfg that are in the config file and are
+// not set by env variables.
+func readConfigFile(cfg *Config) error {
+	data, err := os.ReadFile(ConfigFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	var doc map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parse config file: %w", err)
+	}
+	// report errors in file order
+	entries := make([]fileEntry, 0, len(doc))
+	for key, node := range doc {
+		entries = append(entries, fileEntry{key, node})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].node.Line < entries[j].node.Line
+	})
+	fields := fileFields(cfg)
+	for _, e := range entries {
+		if e.key == fileEnvKey {
+			var vars map[string]string
+			if err := e.node.Decode(&vars); err != nil {
+				return keyError(e.key, err)
+			}
+			names := make([]string, 0, len(vars))
+			for name := range vars {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				cfg.Env = append(cfg.Env, name+"="+vars[name])
+			}
+			continue
+		}
+		field, ok := fields[e.key]
+		if !ok {
+			return keyError(e.key, fmt.Errorf("line %d: unknown key", e.node.Line))
+		}
+		if _, ok := os.LookupEnv("JAIL_" + strings.ToUpper(e.key)); ok {
+			continue
+		}
+		if err := e.node.Decode(field.Addr().Interface()); err != nil {
+			return keyError(e.key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/redpwn/jail/internal/proto/nsjail"
+	"google.golang.org/protobuf/proto"
+)
+
+// tmpfsSrc is the source of a mount that is a new tmpfs instead of a bind
+// mount.
+const tmpfsSrc = "tmpfs"
+
+// Mount is an extra mount in each jail. It is written as
+// src:dst[:options], where options is a comma-separated list of ro, rw,
+// size=<size>, suid, dev, and noexec. Like the built-in mounts, extra mounts
+// are nosuid and nodev unless suid or dev is given.
+type Mount struct {
+	Src    string `yaml:"src"`
+	Dst    string `yaml:"dst"`
+	Rw     bool   `yaml:"rw"`
+	Size   size   `yaml:"size"`
+	Suid   bool   `yaml:"suid"`
+	Dev    bool   `yaml:"dev"`
+	Noexec bool   `yaml:"noexec"`
+}
+
+func (m *Mount) UnmarshalText(t []byte) error {
+	parts := strings.SplitN(string(t), ":", 3)
+	if len(parts) < 2 {
+		return fmt.Errorf("mount %q: expected src:dst[:options]", t)
+	}
+	*m = Mount{Src: parts[0], Dst: parts[1]}
+	if len(parts) < 3 {
+		return nil
+	}
+	for _, opt := range strings.Split(parts[2], ",") {
+		switch {
+		case opt == "ro":
+			m.Rw = false
+		case opt == "rw":
+			m.Rw = true
+		case opt == "suid":
+			m.Suid = true
+		case opt == "nosuid":
+			m.Suid = false
+		case opt == "dev":
+			m.Dev = true
+		case opt == "nodev":
+			m.Dev = false
+		case opt == "noexec":
+			m.Noexec = true
+		case strings.HasPrefix(opt, "size="):
+			if err := m.Size.UnmarshalText([]byte(strings.TrimPrefix(opt, "size="))); err != nil {
+				return fmt.Errorf("mount %q: %w", t, err)
+			}
+		default:
+			return fmt.Errorf("mount %q: unknown option %q", t, opt)
+		}
+	}
+	return nil
+}
+
+func (m *Mount) tmpfs() bool {
+	return m.Src == tmpfsSrc
+}
+
+// validate checks that the mount's paths are absolute and exist.
+func (m *Mount) validate() error {
+	if !path.IsAbs(m.Dst) || path.Clean(m.Dst) == "/" {
+		return fmt.Errorf("destination %q is not an absolute path below /", m.Dst)
+	}
+	// nsjail cannot create mount points in the read-only root
+	if _, err := os.Stat("/srv" + m.Dst); err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+	if m.tmpfs() {
+		return nil
+	}
+	if !path.IsAbs(m.Src) {
+		return fmt.Errorf("source %q is not an absolute path or %s", m.Src, tmpfsSrc)
+	}
+	if _, err := os.Stat(m.Src); err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	if m.Size > 0 {
+		return fmt.Errorf("size is only supported for %s", tmpfsSrc)
+	}
+	return nil
+}
+
+func (m *Mount) mountPt() *nsjail.MountPt {
+	pt := &nsjail.MountPt{
+		Dst:    proto.String(m.Dst),
+		Rw:     proto.Bool(m.Rw),
+		Nosuid: proto.Bool(!m.Suid),
+		Nodev:  proto.Bool(!m.Dev),
+		Noexec: proto.Bool(m.Noexec),
+	}
+	if m.tmpfs() {
+		// a read-only empty tmpfs is not useful
+		pt.Fstype = proto.String("tmpfs")
+		pt.Rw = proto.Bool(true)
+		if m.Size > 0 {
+			pt.Options = proto.String(fmt.Sprintf("size=%d", m.Size))
+		}
+	} else {
+		pt.Src = proto.String(m.Src)
+		pt.IsBind = proto.Bool(true)
+	}
+	return pt
+}
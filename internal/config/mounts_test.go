@@ -0,0 +1,57 @@
+package config
+
+import "testing"
+
+func TestMountUnmarshalText(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    Mount
+		wantErr bool
+	}{
+		{text: "/data:/data", want: Mount{Src: "/data", Dst: "/data"}},
+		{text: "/data:/data:rw", want: Mount{Src: "/data", Dst: "/data", Rw: true}},
+		{text: "/data:/data:rw,ro", want: Mount{Src: "/data", Dst: "/data"}},
+		{text: "tmpfs:/app/cache:size=10M,noexec", want: Mount{Src: "tmpfs", Dst: "/app/cache", Size: 10 * 1024 * 1024, Noexec: true}},
+		{text: "/data:/data:suid,dev", want: Mount{Src: "/data", Dst: "/data", Suid: true, Dev: true}},
+		{text: "/data:/data:suid,nosuid,dev,nodev", want: Mount{Src: "/data", Dst: "/data"}},
+		{text: "/data", wantErr: true},
+		{text: "/data:/data:exec", wantErr: true},
+		{text: "/data:/data:size=big", wantErr: true},
+		{text: "/data:/data:", wantErr: true},
+	}
+	for _, tt := range tests {
+		var m Mount
+		err := m.UnmarshalText([]byte(tt.text))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %+v, want error", tt.text, m)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.text, err)
+			continue
+		}
+		if m != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.text, m, tt.want)
+		}
+	}
+}
+
+func TestMountPt(t *testing.T) {
+	bind := (&Mount{Src: "/data", Dst: "/data"}).mountPt()
+	if !bind.GetIsBind() || bind.GetSrc() != "/data" || bind.GetRw() {
+		t.Errorf("bind mount: got %v", bind)
+	}
+	if !bind.GetNosuid() || !bind.GetNodev() {
+		t.Errorf("bind mount is not nosuid and nodev by default: %v", bind)
+	}
+	opened := (&Mount{Src: "/data", Dst: "/data", Suid: true, Dev: true}).mountPt()
+	if opened.GetNosuid() || opened.GetNodev() {
+		t.Errorf("suid and dev mount: got %v", opened)
+	}
+	tmpfs := (&Mount{Src: "tmpfs", Dst: "/app/cache", Size: 1024}).mountPt()
+	if tmpfs.GetIsBind() || tmpfs.GetFstype() != "tmpfs" || !tmpfs.GetRw() || tmpfs.GetOptions() != "size=1024" {
+		t.Errorf("tmpfs mount: got %v", tmpfs)
+	}
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/docker/go-units"
+	seccomp "github.com/seccomp/libseccomp-golang"
+	"golang.org/x/sys/unix"
+)
+
+// minMem is the smallest memory limit that a jail can exec a typical binary
+// with.
+const minMem = 1024 * 1024
+
+// minPids is the smallest PID limit that lets a jail fork once, as a shell
+// script running a command does.
+const minPids = 2
+
+const appRunPath = "/srv/app/run"
+
+// userId is the UID that the proxy runs as, which is privs.UserId. privs
+// imports this package.
+const userId = 1000
+
+// Permission bits for accessibleBy, in the position of the bits for others.
+const (
+	permRead  = 0o4
+	permWrite = 0o2
+	permExec  = 0o1
+)
+
+// accessibleBy checks that the mode of path gives userId the permissions in
+// perm. ACLs are not checked.
+func accessibleBy(path string, perm uint32) error {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	mode := st.Mode
+	switch {
+	case st.Uid == userId:
+		mode >>= 6
+	case st.Gid == userId:
+		mode >>= 3
+	}
+	if mode&perm != perm {
+		return fmt.Errorf("%s does not have %s permission for UID %d", path, permString(perm), userId)
+	}
+	return nil
+}
+
+func permString(perm uint32) string {
+	s := ""
+	for _, p := range []struct {
+		bit  uint32
+		name string
+	}{{permRead, "r"}, {permWrite, "w"}, {permExec, "x"}} {
+		if perm&p.bit != 0 {
+			s += p.name
+		}
+	}
+	return s
+}
+
+// Validate checks the config and the files it refers to. The returned error
+// lists every problem found.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if c.Mem > 0 && c.Mem < minMem {
+		add("JAIL_MEM: %s is less than the minimum of %s", units.BytesSize(float64(c.Mem)), units.BytesSize(minMem))
+	}
+	if c.Pids > 0 && c.Pids < minPids {
+		add("JAIL_PIDS: %d is less than the minimum of %d, which is needed to run any command from a shell script", c.Pids, minPids)
+	}
+	if c.Ipv4Prefix > 32 {
+		add("JAIL_IPV4_PREFIX: prefix length %d is greater than 32", c.Ipv4Prefix)
+	}
+	if c.Ipv6Prefix > 128 {
+		add("JAIL_IPV6_PREFIX: prefix length %d is greater than 128", c.Ipv6Prefix)
+	}
+	if c.RatePrefix > 128 {
+		add("JAIL_RATE_IPV6_PREFIX: prefix length %d is greater than 128", c.RatePrefix)
+	}
+	if c.PowAdapt != "" && c.PowAdapt != "load" && c.PowAdapt != "rate" {
+		add("JAIL_POW_ADAPT: unknown pow adapt mode %q", c.PowAdapt)
+	} else if c.PowAdapt != "" {
+		if c.PowMax == 0 {
+			add("JAIL_POW_ADAPT: JAIL_POW_MAX must also be set")
+		} else if c.PowMax <= c.Pow {
+			add("JAIL_POW_MAX: %d must be greater than JAIL_POW (%d) for adaptive proof of work", c.PowMax, c.Pow)
+		}
+		if c.PowAdapt == "load" && c.Conns == 0 {
+			add("JAIL_POW_ADAPT: load mode needs JAIL_CONNS to be set")
+		}
+	}
+	if c.LogFormat != "logfmt" && c.LogFormat != "json" {
+		add("JAIL_LOG_FORMAT: unknown log format %q", c.LogFormat)
+	}
+	if c.Mode != "listen" && c.Mode != "once" {
+		add("JAIL_MODE: unknown mode %q", c.Mode)
+	}
+	if c.TlsCert == "" && c.TlsKey != "" || c.TlsCert != "" && c.TlsKey == "" {
+		add("JAIL_TLS_CERT and JAIL_TLS_KEY must be set together")
+	} else if c.Tls() {
+		if _, err := tls.LoadX509KeyPair(c.TlsCert, c.TlsKey); err != nil {
+			add("JAIL_TLS_CERT and JAIL_TLS_KEY: %w", err)
+		} else {
+			for _, path := range []string{c.TlsCert, c.TlsKey} {
+				if err := accessibleBy(path, permRead); err != nil {
+					add("JAIL_TLS_CERT and JAIL_TLS_KEY: %w", err)
+				}
+			}
+		}
+	}
+	if c.AuthTokens != "" {
+		if _, err := ReadAuthTokens(c.AuthTokens); err != nil {
+			add("JAIL_AUTH_TOKENS: %w", err)
+		} else if err := accessibleBy(c.AuthTokens, permRead); err != nil {
+			add("JAIL_AUTH_TOKENS: %w", err)
+		}
+	}
+	if c.Record() {
+		if info, err := os.Stat(c.RecordDir); err != nil {
+			add("JAIL_RECORD_DIR: %w", err)
+		} else if !info.IsDir() {
+			add("JAIL_RECORD_DIR: %s is not a directory", c.RecordDir)
+		} else if err := accessibleBy(c.RecordDir, permWrite|permExec); err != nil {
+			add("JAIL_RECORD_DIR: %w", err)
+		}
+	}
+	if c.FlagSecret != "" && c.FlagPath == "" && c.FlagEnv == "" {
+		add("JAIL_FLAG_SECRET: JAIL_FLAG_PATH or JAIL_FLAG_ENV must also be set")
+	}
+	if c.FlagPath != "" {
+		if _, err := os.Stat("/srv" + c.FlagPath); err != nil {
+			add("JAIL_FLAG_PATH: %w", err)
+		}
+	}
+
+	if c.Port == 0 || c.Port > 65535 {
+		add("JAIL_PORT: %d is not a valid port", c.Port)
+	} else if port, proxy := c.NsjailListen(); proxy && !c.Once() {
+		// nsjail listens on the next port behind the proxy
+		if port > 65535 {
+			add("JAIL_PORT: %d is the last port, but the next port is needed for nsjail", c.Port)
+		} else if port == c.MetricsPort {
+			add("JAIL_METRICS_PORT: %d is used by nsjail, which listens on JAIL_PORT+1", c.MetricsPort)
+		}
+	}
+	if c.MetricsPort > 65535 {
+		add("JAIL_METRICS_PORT: %d is not a valid port", c.MetricsPort)
+	} else if c.MetricsPort > 0 && c.MetricsPort == c.Port {
+		add("JAIL_METRICS_PORT: %d is the same as JAIL_PORT", c.MetricsPort)
+	}
+
+	if c.Overlay() {
+		if _, err := os.Stat(OverlayPath); err != nil {
+			add("JAIL_OVERLAY_SIZE: %w", err)
+		}
+	}
+	for _, m := range c.Mounts {
+		if err := m.validate(); err != nil {
+			add("JAIL_MOUNTS: %s: %w", m.Dst, err)
+		}
+	}
+	for _, name := range c.Syscalls {
+		if _, err := seccomp.GetSyscallFromName(name); err != nil {
+			add("JAIL_SYSCALLS: unknown syscall %q", name)
+		}
+	}
+
+	if info, err := os.Stat(appRunPath); err != nil {
+		add("%w", err)
+	} else if !info.Mode().IsRegular() || info.Mode()&0o111 == 0 {
+		add("%s is not an executable file", appRunPath)
+	}
+	if _, err := os.Stat("/srv/dev"); err == nil {
+		for _, name := range c.Dev {
+			src := "/dev/" + name
+			stx := &unix.Statx_t{}
+			if err := unix.Statx(0, src, 0, unix.STATX_TYPE, stx); err != nil {
+				add("JAIL_DEV: %s: %w", src, err)
+				continue
+			}
+			if t := stx.Mode & unix.S_IFMT; t != unix.S_IFBLK && t != unix.S_IFCHR {
+				add("JAIL_DEV: %s is not a block or char device", src)
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+}
@@ -59,3 +59,20 @@ func initSeccomp(cfg *config.Config) error {
 	}
 	return nil
 }
+
+// AllowedSyscalls returns the names of the syscalls that the seccomp filter
+// allows, skipping syscalls unknown to libseccomp like initSeccomp does.
+func AllowedSyscalls(cfg *config.Config) []string {
+	var names []string
+	for _, rule := range seccompRules {
+		if rule.act != seccomp.ActAllow {
+			continue
+		}
+		for _, name := range rule.names {
+			if _, err := seccomp.GetSyscallFromName(name); err == nil {
+				names = append(names, name)
+			}
+		}
+	}
+	return append(names, cfg.Syscalls...)
+}
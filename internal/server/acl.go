@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/redpwn/jail/internal/config"
+	"golang.org/x/sys/unix"
+)
+
+const aclPollInterval = 5 * time.Second
+
+// acl is a set of allowed and denied client prefixes.
+type acl struct {
+	allow []netip.Prefix // empty allows all
+	deny  []netip.Prefix
+}
+
+// readPrefixes reads a file of prefixes or addresses, one per line.
+func readPrefixes(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var prefixes []netip.Prefix
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text, _, _ := strings.Cut(s.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if !strings.Contains(text, "/") {
+			addr, err := netip.ParseAddr(text)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+func loadAcl() (*acl, error) {
+	allow, err := readPrefixes(config.AllowListPath)
+	if err != nil {
+		return nil, fmt.Errorf("read allow list: %w", err)
+	}
+	deny, err := readPrefixes(config.DenyListPath)
+	if err != nil {
+		return nil, fmt.Errorf("read deny list: %w", err)
+	}
+	if len(allow) == 0 {
+		// an empty allow list is the same as no allow list
+		allow = nil
+	}
+	return &acl{allow: allow, deny: deny}, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *acl) permits(ip netip.Addr) bool {
+	if containsAddr(a.deny, ip) {
+		return false
+	}
+	return a.allow == nil || containsAddr(a.allow, ip)
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statAcl() [2]fileStamp {
+	stamps := [2]fileStamp{}
+	for i, path := range []string{config.AllowListPath, config.DenyListPath} {
+		if info, err := os.Stat(path); err == nil {
+			stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// watchAcl reloads the allow and deny lists on SIGHUP or when either file
+// changes. If a reload fails, the previous lists stay in effect.
+func (p *proxyServer) watchAcl() {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, unix.SIGHUP)
+	ticker := time.NewTicker(aclPollInterval)
+	defer ticker.Stop()
+	stamps := statAcl()
+	for {
+		select {
+		case <-hupCh:
+		case <-ticker.C:
+			newStamps := statAcl()
+			if newStamps == stamps {
+				continue
+			}
+			stamps = newStamps
+		}
+		a, err := loadAcl()
+		if err != nil {
+			p.log.Error("reload acl", "err", err)
+			continue
+		}
+		p.acl.Store(a)
+		p.log.Info("reload acl", "allow", len(a.allow), "deny", len(a.deny))
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadPrefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", content: "", want: nil},
+		{name: "comments and blank lines", content: "# allow list\n\n   \n# 192.0.2.1\n", want: nil},
+		{name: "ipv4 address", content: "192.0.2.1\n", want: []string{"192.0.2.1/32"}},
+		{name: "ipv6 address", content: "2001:db8::1\n", want: []string{"2001:db8::1/128"}},
+		{name: "mapped ipv4 address", content: "::ffff:192.0.2.1\n", want: []string{"192.0.2.1/32"}},
+		{name: "prefixes are masked", content: "192.0.2.77/24\n2001:db8::1/32\n", want: []string{"192.0.2.0/24", "2001:db8::/32"}},
+		{name: "trailing comment and whitespace", content: "  192.0.2.0/24  # office\n", want: []string{"192.0.2.0/24"}},
+		{name: "no trailing newline", content: "192.0.2.1", want: []string{"192.0.2.1/32"}},
+		{name: "bad address", content: "192.0.2.1\n192.0.2\n", wantErr: true},
+		{name: "bad prefix length", content: "192.0.2.0/33\n", wantErr: true},
+		{name: "hostname", content: "example.com\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "list.txt")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			prefixes, err := readPrefixes(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want error", prefixes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, p := range prefixes {
+				got = append(got, p.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPrefixesMissing(t *testing.T) {
+	prefixes, err := readPrefixes(filepath.Join(t.TempDir(), "missing.txt"))
+	if err != nil || prefixes != nil {
+		t.Errorf("got %v, %v, want no prefixes and no error", prefixes, err)
+	}
+}
+
+func TestAclPermits(t *testing.T) {
+	a := &acl{
+		allow: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")},
+		deny:  []netip.Prefix{netip.MustParsePrefix("192.0.2.128/25")},
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.200", false},
+		{"198.51.100.1", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, tt := range tests {
+		if got := a.permits(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("permits(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	open := &acl{deny: a.deny}
+	if !open.permits(netip.MustParseAddr("198.51.100.1")) {
+		t.Error("nil allow list does not permit an address that is not denied")
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/redpwn/jail/internal/config"
+)
+
+const (
+	authTimeout     = time.Minute
+	authMaxTokenLen = 256
+)
+
+// authenticator maps team tokens to team IDs.
+type authenticator struct {
+	tokens map[string]string
+	secret []byte
+}
+
+func loadAuth(cfg *config.Config) (*authenticator, error) {
+	if !cfg.Auth() {
+		return nil, nil
+	}
+	a := &authenticator{secret: []byte(cfg.AuthSecret)}
+	if cfg.AuthTokens != "" {
+		tokens, err := config.ReadAuthTokens(cfg.AuthTokens)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = tokens
+	}
+	return a, nil
+}
+
+// AuthToken returns the signed token for team, in the form team.signature.
+func AuthToken(secret string, team string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(team))
+	return team + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// team returns the team ID for token, or false if the token is invalid.
+func (a *authenticator) team(token string) (string, bool) {
+	if team, ok := a.tokens[token]; ok {
+		return team, true
+	}
+	if len(a.secret) == 0 {
+		return "", false
+	}
+	i := strings.LastIndexByte(token, '.')
+	if i <= 0 {
+		return "", false
+	}
+	team := token[:i]
+	if !hmac.Equal([]byte(token), []byte(AuthToken(string(a.secret), team))) {
+		return "", false
+	}
+	return team, true
+}
+
+// readLine reads a line one byte at a time so that no input after the line
+// is consumed.
+func readLine(r io.Reader, max int) (string, error) {
+	line := make([]byte, 0, max)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		if len(line) >= max {
+			return "", errors.New("line too long")
+		}
+		line = append(line, b[0])
+	}
+}
+
+// checkAuth prompts for a team token and returns the authenticated team ID.
+func (p *proxyServer) checkAuth(conn net.Conn, s *session) (string, bool) {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	fmt.Fprint(conn, "team token: ")
+	token, err := readLine(conn, authMaxTokenLen)
+	if err != nil {
+		s.log.Info("auth", "err", err)
+		return "", false
+	}
+	team, ok := p.auth.team(strings.TrimSpace(token))
+	if !ok {
+		s.log.Info("bad auth")
+		p.metrics.rejected.inc(rejectBadAuth)
+		conn.Write([]byte("incorrect team token\n"))
+		return "", false
+	}
+	s.team = team
+	s.log = s.log.With("team", team)
+	s.log.Info("auth")
+	return team, true
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const copyBufSize = 32 * 1024
+
+// direction describes one direction of a forwarded session.
+type direction struct {
+	name     string
+	maxBytes uint64
+	count    *atomic.Uint64
+	rec      *recorder
+	kind     byte
+	// halfClose is whether the end of input is passed on with CloseWrite
+	// instead of ending the session
+	halfClose bool
+}
+
+// directions returns the directions of a session. If rec is not nil, data is
+// recorded to it.
+func (p *proxyServer) directions(rec *recorder) (in *direction, out *direction) {
+	in = &direction{name: "in", maxBytes: uint64(p.cfg.MaxBytesIn), count: &p.metrics.bytesIn, rec: rec, kind: recordIn, halfClose: true}
+	out = &direction{name: "out", maxBytes: uint64(p.cfg.MaxBytesOut), count: &p.metrics.bytesOut, rec: rec, kind: recordOut}
+	return in, out
+}
+
+// throttle limits the average rate of bytes passing through it. It is shared
+// by both directions of a session.
+type throttle struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newThrottle(rate uint64) *throttle {
+	return &throttle{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (t *throttle) wait(n int) {
+	t.mu.Lock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		// allow bursts of up to one second
+		t.tokens = t.rate
+	}
+	t.last = now
+	t.tokens -= float64(n)
+	// sleep without the lock, so the other direction can take its turn
+	delay := time.Duration(-t.tokens / t.rate * float64(time.Second))
+	t.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// copy reasons other than the end of input
+const (
+	endIdle          = "idle timeout"
+	endMaxBytes      = "byte limit exceeded"
+	endHalfCloseTime = "timeout after end of input"
+)
+
+// endHalfClose is sent by runCopy when a direction was half-closed, and is
+// never reported to clients.
+const endHalfClose = "half close"
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// runCopy copies src to dst until either fails or the direction's byte limit
+// is reached, then sends the reason the copy ended to ch. The reason is
+// empty if src or dst ended normally.
+func (p *proxyServer) runCopy(dst io.Writer, src io.Reader, s *session, d *direction, ch chan<- string) {
+	err := p.copyDirection(dst, src, s, d)
+	if errors.Is(err, errMaxBytes) {
+		ch <- d.name + " " + endMaxBytes
+		return
+	}
+	if err == io.EOF && d.halfClose {
+		if cw, ok := dst.(closeWriter); ok {
+			if err := cw.CloseWrite(); err == nil {
+				ch <- endHalfClose
+				return
+			}
+		}
+	}
+	if err != io.EOF && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrClosed) {
+		s.log.Warn("copy", "direction", d.name, "err", err)
+	}
+	ch <- ""
+}
+
+// waitCopy waits for a session started with runCopy to end and returns the
+// reason, which is empty if it ended normally. After input is half-closed,
+// the session continues until output ends or the half-close timeout.
+func (p *proxyServer) waitCopy(s *session, ch <-chan string) string {
+	var timeout <-chan time.Time
+	for {
+		select {
+		case reason := <-ch:
+			if reason != endHalfClose {
+				return reason
+			}
+			s.log.Info("half close")
+			if p.cfg.HalfCloseTimeout > 0 {
+				timer := time.NewTimer(time.Duration(p.cfg.HalfCloseTimeout) * time.Second)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+		case <-timeout:
+			return endHalfCloseTime
+		}
+	}
+}
+
+// copyDirection copies src to dst with the fastest method that applies the
+// limits of the session. It returns io.EOF if src ended.
+func (p *proxyServer) copyDirection(dst io.Writer, src io.Reader, s *session, d *direction) error {
+	if tdst, tsrc, ok := p.tcpConns(dst, src, d); ok {
+		return tcpCopy(tdst, tsrc, d)
+	}
+	if rdst, rsrc, ok := p.spliceConns(dst, src, d); ok {
+		return spliceCopy(rdst, rsrc, s, d)
+	}
+	return p.bufferedCopy(dst, src, s, d)
+}
+
+// bufferedCopy copies src to dst through a buffer, applying every limit of
+// the session.
+func (p *proxyServer) bufferedCopy(dst io.Writer, src io.Reader, s *session, d *direction) error {
+	size := copyBufSize
+	t := s.throttle
+	if t != nil {
+		size = int(min(uint64(size), uint64(p.cfg.Bandwidth)))
+	}
+	buf := make([]byte, size)
+	total := uint64(0)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			s.lastActive.Store(time.Now().UnixNano())
+			if d.maxBytes > 0 && total+uint64(n) > d.maxBytes {
+				n = int(d.maxBytes - total)
+				err = errMaxBytes
+			}
+			if t != nil {
+				t.wait(n)
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil && err == nil {
+				err = werr
+			}
+			if d.rec != nil {
+				d.rec.record(d.kind, buf[:n])
+			}
+			total += uint64(n)
+			d.count.Add(uint64(n))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var errMaxBytes = errors.New(endMaxBytes)
+
+// watchIdle sends endIdle to ch if the session has no activity in either
+// direction for the idle timeout. It returns when done is closed.
+func (p *proxyServer) watchIdle(s *session, ch chan<- string, done <-chan struct{}) {
+	timeout := time.Duration(p.cfg.IdleTimeout) * time.Second
+	ticker := time.NewTicker(min(timeout/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, s.lastActive.Load())) >= timeout {
+				ch <- endIdle
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/redpwn/jail/internal/config"
+)
+
+// benchChunk is the data forwarded in one benchmark iteration.
+const benchChunk = 1024 * 1024
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(b *testing.B) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// pipePair returns the read and write ends of a pipe, like the stdio of a
+// jail started by startJail.
+func pipePair(b *testing.B) (*os.File, *os.File) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+	return r, w
+}
+
+// endpoint is one side of a forwarded direction. The proxy uses conn, and the
+// benchmark uses peer to send or receive data.
+type endpoint struct {
+	conn any
+	peer any
+}
+
+func tcpEndpoint(b *testing.B) endpoint {
+	c, s := tcpPair(b)
+	return endpoint{conn: s, peer: c}
+}
+
+// pipeSrc and pipeDst return the jail's stdout and stdin in once mode.
+func pipeSrc(b *testing.B) endpoint {
+	r, w := pipePair(b)
+	return endpoint{conn: r, peer: w}
+}
+
+func pipeDst(b *testing.B) endpoint {
+	r, w := pipePair(b)
+	return endpoint{conn: w, peer: r}
+}
+
+// copyFunc forwards src to dst until src ends.
+type copyFunc func(p *proxyServer, dst any, src any, s *session, d *direction) error
+
+func bufferedCopyFunc(p *proxyServer, dst any, src any, s *session, d *direction) error {
+	return p.bufferedCopy(dst.(io.Writer), src.(io.Reader), s, d)
+}
+
+func spliceCopyFunc(p *proxyServer, dst any, src any, s *session, d *direction) error {
+	rdst, rsrc, ok := p.spliceConns(dst.(io.Writer), src.(io.Reader), d)
+	if !ok {
+		return io.ErrUnexpectedEOF
+	}
+	return spliceCopy(rdst, rsrc, s, d)
+}
+
+// proxyCopyFunc is the method that runCopy chooses for the direction.
+func proxyCopyFunc(p *proxyServer, dst any, src any, s *session, d *direction) error {
+	return p.copyDirection(dst.(io.Writer), src.(io.Reader), s, d)
+}
+
+// stdlibCopyFunc is io.Copy, which already splices from TCP to TCP with
+// TCPConn.ReadFrom, but does not count bytes or apply session limits.
+func stdlibCopyFunc(p *proxyServer, dst any, src any, s *session, d *direction) error {
+	_, err := io.Copy(dst.(io.Writer), src.(io.Reader))
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+// cpuTime returns the user and system CPU time used by the process.
+func cpuTime(b *testing.B) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func benchCopy(b *testing.B, fn copyFunc, newSrc func(*testing.B) endpoint, newDst func(*testing.B) endpoint) {
+	src, dst := newSrc(b), newDst(b)
+	p := &proxyServer{cfg: &config.Config{}}
+	s := &session{}
+	d := &direction{name: "bench", count: &atomic.Uint64{}}
+	copyErr := make(chan error, 1)
+	go func() {
+		err := fn(p, dst.conn, src.conn, s, d)
+		// end the receiver when the copy ends, even if it failed
+		dst.conn.(io.Closer).Close()
+		copyErr <- err
+	}()
+	recvErr := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(io.Discard, dst.peer.(io.Reader), int64(b.N)*benchChunk)
+		recvErr <- err
+	}()
+
+	chunk := make([]byte, benchChunk)
+	b.SetBytes(benchChunk)
+	b.ResetTimer()
+	startCpu := cpuTime(b)
+	w := src.peer.(io.WriteCloser)
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-recvErr; err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	// CPU time of the whole process, including the sender and receiver, which
+	// is the same for every copy function
+	b.ReportMetric(float64(cpuTime(b)-startCpu)/float64(b.N), "cpu-ns/op")
+	w.Close()
+	if err := <-copyErr; err != io.EOF {
+		b.Fatal(err)
+	}
+	if d.count.Load() != 0 && d.count.Load() != uint64(b.N)*benchChunk {
+		b.Fatalf("counted %d bytes, want %d", d.count.Load(), uint64(b.N)*benchChunk)
+	}
+}
+
+// BenchmarkProxyCopy compares forwarding through the proxy's buffer with
+// spliceCopy, for TCP clients and for the pipes of jails in once mode. The
+// proxy case is the method that runCopy chooses when no limits are set.
+func BenchmarkProxyCopy(b *testing.B) {
+	paths := []struct {
+		name   string
+		src    func(*testing.B) endpoint
+		dst    func(*testing.B) endpoint
+		stdlib bool
+	}{
+		{"tcp-tcp", tcpEndpoint, tcpEndpoint, true},
+		{"tcp-pipe", tcpEndpoint, pipeDst, false},
+		{"pipe-tcp", pipeSrc, tcpEndpoint, false},
+	}
+	for _, path := range paths {
+		b.Run(path.name+"/buffered", func(b *testing.B) {
+			benchCopy(b, bufferedCopyFunc, path.src, path.dst)
+		})
+		b.Run(path.name+"/splice", func(b *testing.B) {
+			benchCopy(b, spliceCopyFunc, path.src, path.dst)
+		})
+		b.Run(path.name+"/proxy", func(b *testing.B) {
+			benchCopy(b, proxyCopyFunc, path.src, path.dst)
+		})
+		if path.stdlib {
+			b.Run(path.name+"/stdlib", func(b *testing.B) {
+				benchCopy(b, stdlibCopyFunc, path.src, path.dst)
+			})
+		}
+	}
+}
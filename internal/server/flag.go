@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/redpwn/jail/internal/proto/nsjail"
+	"google.golang.org/protobuf/proto"
+)
+
+// sessionFlag returns a flag unique to the session's team, or to the session
+// if it is not authenticated.
+func (p *proxyServer) sessionFlag(s *session) string {
+	id := "session:" + s.id
+	if s.team != "" {
+		id = "team:" + s.team
+	}
+	mac := hmac.New(sha256.New, []byte(p.cfg.FlagSecret))
+	mac.Write([]byte(id))
+	return strings.ReplaceAll(p.cfg.FlagFormat, "%s", hex.EncodeToString(mac.Sum(nil))[:32])
+}
+
+// setFlag adds the session's flag to a jail config.
+func (p *proxyServer) setFlag(msg *nsjail.NsJailConfig, s *session) {
+	if p.cfg.FlagSecret == "" {
+		return
+	}
+	flag := p.sessionFlag(s)
+	// logged for looking up shared flags
+	s.log.Info("flag", "flag", flag)
+	if p.cfg.FlagEnv != "" {
+		msg.Envar = append(msg.Envar, p.cfg.FlagEnv+"="+flag)
+	}
+	if p.cfg.FlagPath != "" {
+		msg.Mount = append(msg.Mount, &nsjail.MountPt{
+			SrcContent: []byte(flag + "\n"),
+			Dst:        proto.String(p.cfg.FlagPath),
+			IsBind:     proto.Bool(true),
+			Nodev:      proto.Bool(true),
+			Nosuid:     proto.Bool(true),
+			Noexec:     proto.Bool(true),
+		})
+	}
+}
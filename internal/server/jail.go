@@ -0,0 +1,177 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/redpwn/jail/internal/config"
+	"github.com/redpwn/jail/internal/proto/nsjail"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// jail is the jailed end of a forwarded connection.
+type jail interface {
+	io.ReadWriteCloser
+}
+
+func (p *proxyServer) dialJail(s *session) (jail, error) {
+	port, _ := p.cfg.NsjailListen()
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	// nsjail logs connections by their source address
+	s.log.Info("forwarding", "nsjail_peer", conn.LocalAddr().String())
+	return conn, nil
+}
+
+// onceJail is an nsjail process in once mode with its stdio connected to a
+// single session. If the client's socket is the stdio of the jail, stdin and
+// stdout are nil and the session ends when done is closed.
+type onceJail struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *os.File
+	cleanup func()
+	s       *session
+	done    chan struct{}
+	waitErr error
+}
+
+func (j *onceJail) Read(b []byte) (int, error) {
+	return j.stdout.Read(b)
+}
+
+func (j *onceJail) Write(b []byte) (int, error) {
+	return j.stdin.Write(b)
+}
+
+// CloseWrite closes the stdin of the jail.
+func (j *onceJail) CloseWrite() error {
+	return j.stdin.Close()
+}
+
+func (j *onceJail) direct() bool {
+	return j.stdin == nil
+}
+
+func (j *onceJail) Close() error {
+	if !j.direct() {
+		j.stdin.Close()
+	}
+	select {
+	case <-j.done:
+	default:
+		// nsjail kills the jail on SIGTERM
+		if err := j.cmd.Process.Signal(unix.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			j.s.log.Warn("signal nsjail", "err", err)
+		}
+		<-j.done
+	}
+	if !j.direct() {
+		j.stdout.Close()
+	}
+	j.cleanup()
+	j.s.log.Info("nsjail exit", "code", j.cmd.ProcessState.ExitCode())
+	var exitErr *exec.ExitError
+	if errors.As(j.waitErr, &exitErr) {
+		return nil
+	}
+	return j.waitErr
+}
+
+// directFile returns a copy of the client's socket to use as the stdio of a
+// jail, or nil if session data must pass through the proxy.
+func (p *proxyServer) directFile(conn net.Conn, buf []byte) *os.File {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok || len(buf) > 0 || p.cfg.Record() || p.cfg.LimitsCopy() {
+		return nil
+	}
+	f, err := tc.File()
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
+// nsjailLogFd is the fd in nsjail processes started by startJail that nsjail
+// logs to, since stderr belongs to the jail.
+const nsjailLogFd = 3
+
+// startJail runs nsjail in once mode for a session. If conn is not nil, it is
+// used as the stdio of the jail. Otherwise, the jail's stdio is pipes, and
+// its stdout and stderr are merged.
+func (p *proxyServer) startJail(s *session, conn *os.File) (jail, error) {
+	msg := proto.Clone(p.nsjailCfg).(*nsjail.NsJailConfig)
+	msg.Mode = nsjail.Mode_ONCE.Enum()
+	msg.LogFd = proto.Int32(nsjailLogFd)
+	msg.Envar = append(msg.Envar, "JAIL_SESSION_ID="+s.id)
+	if s.team != "" {
+		msg.Envar = append(msg.Envar, "JAIL_TEAM_ID="+s.team)
+	}
+	p.setFlag(msg, s)
+	cfgPath := fmt.Sprintf("/tmp/nsjail-%s.cfg", s.id)
+	cleanup := func() {
+		os.Remove(cfgPath)
+	}
+	if p.cfg.Overlay() {
+		if err := p.setOverlay(msg, s); err != nil {
+			return nil, err
+		}
+		cleanup = func() {
+			os.Remove(cfgPath)
+			p.removeOverlay(s)
+		}
+	}
+	if err := config.WriteConfigFile(cfgPath, msg); err != nil {
+		cleanup()
+		return nil, err
+	}
+	cmd := exec.Command(nsjailPath, "-C", cfgPath)
+	cmd.ExtraFiles = []*os.File{os.Stderr}
+	cmd.SysProcAttr = &unix.SysProcAttr{Pdeathsig: unix.SIGTERM}
+	j := &onceJail{
+		cmd:     cmd,
+		cleanup: cleanup,
+		s:       s,
+		done:    make(chan struct{}),
+	}
+	if conn != nil {
+		cmd.Stdin = conn
+		cmd.Stdout = conn
+		cmd.Stderr = conn
+	} else {
+		r, w, err := os.Pipe()
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		defer w.Close()
+		cmd.Stdout = w
+		cmd.Stderr = w
+		if j.stdin, err = cmd.StdinPipe(); err != nil {
+			r.Close()
+			cleanup()
+			return nil, err
+		}
+		j.stdout = r
+	}
+	if err := cmd.Start(); err != nil {
+		if j.stdout != nil {
+			j.stdout.Close()
+		}
+		cleanup()
+		return nil, fmt.Errorf("start nsjail: %w", err)
+	}
+	go func() {
+		j.waitErr = cmd.Wait()
+		close(j.done)
+	}()
+	s.log.Info("forwarding", "nsjail_pid", cmd.Process.Pid, "direct", conn != nil)
+	return j, nil
+}
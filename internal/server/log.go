@@ -0,0 +1,29 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/redpwn/jail/internal/config"
+)
+
+func newLogger(cfg *config.Config) (*slog.Logger, error) {
+	switch cfg.LogFormat {
+	case "logfmt":
+		return slog.New(slog.NewTextHandler(os.Stderr, nil)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, nil)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", cfg.LogFormat)
+}
+
+func newSessionId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
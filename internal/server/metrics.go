@@ -0,0 +1,155 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counterVec is a counter with a single label.
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	c := &counterVec{values: make(map[string]uint64)}
+	for _, l := range labels {
+		c.values[l] = 0
+	}
+	return c
+}
+
+func (c *counterVec) inc(label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[label]++
+}
+
+func (c *counterVec) write(w io.Writer, name string, label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, c.values[k])
+	}
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.buckets[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, b, h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+const (
+	rejectLimit     = "limit"
+	rejectRateLimit = "rate_limit"
+	rejectBadPow    = "bad_pow"
+	rejectDial      = "dial"
+
+	rejectQueueTimeout = "queue_timeout"
+	rejectPowTimeout   = "pow_timeout"
+	rejectBadAuth      = "bad_auth"
+	rejectDenied       = "denied"
+)
+
+type metrics struct {
+	accepted   atomic.Uint64
+	rejected   *counterVec
+	powSolve   *histogram
+	sessionDur *histogram
+	bytesIn    atomic.Uint64
+	bytesOut   atomic.Uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rejected:   newCounterVec(rejectLimit, rejectRateLimit, rejectBadPow, rejectDial, rejectQueueTimeout, rejectPowTimeout, rejectBadAuth, rejectDenied),
+		powSolve:   newHistogram(1, 2, 5, 10, 20, 30, 60, 120),
+		sessionDur: newHistogram(1, 5, 10, 30, 60, 120, 300, 600, 1800),
+	}
+}
+
+func (p *proxyServer) writeMetrics(w io.Writer) {
+	p.countMu.Lock()
+	total, ips, queued := p.countTotal, len(p.countPerIp), len(p.queue)
+	p.countMu.Unlock()
+	m := p.metrics
+
+	fmt.Fprintln(w, "# HELP jail_connections_active Connections currently holding a slot.")
+	fmt.Fprintln(w, "# TYPE jail_connections_active gauge")
+	fmt.Fprintf(w, "jail_connections_active %d\n", total)
+	fmt.Fprintln(w, "# HELP jail_connection_ips_active IP prefixes with at least one active connection.")
+	fmt.Fprintln(w, "# TYPE jail_connection_ips_active gauge")
+	fmt.Fprintf(w, "jail_connection_ips_active %d\n", ips)
+	fmt.Fprintln(w, "# HELP jail_connections_queued Connections waiting for a slot.")
+	fmt.Fprintln(w, "# TYPE jail_connections_queued gauge")
+	fmt.Fprintf(w, "jail_connections_queued %d\n", queued)
+	fmt.Fprintln(w, "# HELP jail_connections_accepted_total Connections forwarded to a jail.")
+	fmt.Fprintln(w, "# TYPE jail_connections_accepted_total counter")
+	fmt.Fprintf(w, "jail_connections_accepted_total %d\n", m.accepted.Load())
+	fmt.Fprintln(w, "# HELP jail_connections_rejected_total Connections rejected before reaching a jail.")
+	fmt.Fprintln(w, "# TYPE jail_connections_rejected_total counter")
+	m.rejected.write(w, "jail_connections_rejected_total", "reason")
+	fmt.Fprintln(w, "# HELP jail_pow_solve_seconds Time taken by clients to submit a correct proof of work.")
+	fmt.Fprintln(w, "# TYPE jail_pow_solve_seconds histogram")
+	m.powSolve.write(w, "jail_pow_solve_seconds")
+	fmt.Fprintln(w, "# HELP jail_session_duration_seconds Time connections spent forwarded to a jail.")
+	fmt.Fprintln(w, "# TYPE jail_session_duration_seconds histogram")
+	m.sessionDur.write(w, "jail_session_duration_seconds")
+	fmt.Fprintln(w, "# HELP jail_copy_bytes_total Bytes copied between clients and jails.")
+	fmt.Fprintln(w, "# TYPE jail_copy_bytes_total counter")
+	fmt.Fprintf(w, "jail_copy_bytes_total{direction=\"in\"} %d\n", m.bytesIn.Load())
+	fmt.Fprintf(w, "jail_copy_bytes_total{direction=\"out\"} %d\n", m.bytesOut.Load())
+}
+
+func (p *proxyServer) startMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		p.writeMetrics(w)
+	})
+	p.log.Info("metrics listening", "port", p.cfg.MetricsPort)
+	p.fatal(http.ListenAndServe(fmt.Sprintf(":%d", p.cfg.MetricsPort), mux))
+}
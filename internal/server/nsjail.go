@@ -1,9 +1,11 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/redpwn/jail/internal/config"
 	"github.com/redpwn/jail/internal/privs"
@@ -12,13 +14,51 @@ import (
 
 const nsjailPath = "/jail/nsjail"
 
-func runNsjailChild(errCh chan<- error) {
+const nsjailStopTimeout = 5 * time.Second
+
+type nsjailChild struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+func startNsjailChild(errCh chan<- error) (*nsjailChild, error) {
 	cmd := exec.Command(nsjailPath, "-C", config.NsjailConfigPath)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		errCh <- fmt.Errorf("run nsjail child: %w", err)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start nsjail child: %w", err)
 	}
+	c := &nsjailChild{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		close(c.done)
+		if err == nil {
+			err = errors.New("exited")
+		}
+		select {
+		case errCh <- fmt.Errorf("run nsjail child: %w", err):
+		default:
+		}
+	}()
+	return c, nil
+}
+
+// stop asks nsjail to exit, which kills all running jails, and kills it if
+// it does not exit in time.
+func (c *nsjailChild) stop() error {
+	if err := c.cmd.Process.Signal(unix.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("signal nsjail child: %w", err)
+	}
+	select {
+	case <-c.done:
+		return nil
+	case <-time.After(nsjailStopTimeout):
+	}
+	if err := c.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("kill nsjail child: %w", err)
+	}
+	<-c.done
+	return nil
 }
 
 func execNsjail(cfg *config.Config) error {
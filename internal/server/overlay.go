@@ -0,0 +1,221 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/redpwn/jail/internal/config"
+	"github.com/redpwn/jail/internal/proto/nsjail"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// overlayHelperFd is the fd of the socket to the proxy in the overlay helper.
+const overlayHelperFd = 3
+
+const overlayMsgSize = 512
+
+var sessionIdRe = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// The overlay helper runs as root for the life of the proxy, so that overlays
+// are mounted in the container's user namespace. An unprivileged overlay
+// cannot copy up files owned by users outside its namespace, which includes
+// most of /srv.
+//
+// The proxy sends "mount <session ID>" or "unmount <session ID>" as one
+// packet, and the helper replies with an empty packet or an error message.
+
+// startOverlayHelper starts the overlay helper and returns the fd of the
+// socket to it, which is inherited by the proxy. It must be called before
+// privileges are dropped.
+func startOverlayHelper(cfg *config.Config) (int, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, fmt.Errorf("overlay socketpair: %w", err)
+	}
+	helperEnd := os.NewFile(uintptr(fds[1]), "overlay")
+	defer helperEnd.Close()
+	cmd := exec.Command(runPath, "overlay", fmt.Sprint(uint64(cfg.OverlaySize)))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{helperEnd}
+	cmd.SysProcAttr = &unix.SysProcAttr{Pdeathsig: unix.SIGKILL}
+	if err := cmd.Start(); err != nil {
+		unix.Close(fds[0])
+		return 0, fmt.Errorf("start overlay helper: %w", err)
+	}
+	// the proxy is executed in place of this process
+	if _, err := unix.FcntlInt(uintptr(fds[0]), unix.F_SETFD, 0); err != nil {
+		unix.Close(fds[0])
+		return 0, fmt.Errorf("overlay socket: %w", err)
+	}
+	return fds[0], nil
+}
+
+func overlayDir(id string) string {
+	return filepath.Join(config.OverlayPath, id)
+}
+
+func overlayRoot(id string) string {
+	return filepath.Join(overlayDir(id), "root")
+}
+
+// mountOverlay mounts the overlay for a session. If it fails, nothing is left
+// mounted.
+func mountOverlay(size string, id string) error {
+	dir := overlayDir(id)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return err
+	}
+	if err := mountOverlayDir(dir, size, id); err != nil {
+		if uerr := unmountOverlay(id); uerr != nil {
+			return fmt.Errorf("%w (cleanup: %v)", err, uerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func mountOverlayDir(dir string, size string, id string) error {
+	if err := unix.Mount("", dir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755,size="+size); err != nil {
+		return fmt.Errorf("mount overlay tmpfs: %w", err)
+	}
+	upper, work, root := filepath.Join(dir, "upper"), filepath.Join(dir, "work"), overlayRoot(id)
+	for _, d := range []string{upper, work, root} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			return err
+		}
+	}
+	opts := fmt.Sprintf("lowerdir=/srv,upperdir=%s,workdir=%s", upper, work)
+	if err := unix.Mount("overlay", root, "overlay", unix.MS_NOSUID|unix.MS_NODEV, opts); err != nil {
+		return fmt.Errorf("mount overlay: %w", err)
+	}
+	return nil
+}
+
+func unmountOverlay(id string) error {
+	dir := overlayDir(id)
+	// after a failed mount, the root may not exist or not be mounted
+	if err := unix.Unmount(overlayRoot(id), unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("unmount overlay: %w", err)
+	}
+	if err := unix.Unmount(dir, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("unmount overlay tmpfs: %w", err)
+	}
+	return os.Remove(dir)
+}
+
+// RunOverlay runs the overlay helper, which handles requests from the proxy
+// until the proxy exits.
+func RunOverlay(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: jailrun overlay <size>")
+	}
+	size := args[0]
+	if err := unix.Mount("", config.OverlayPath, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=0755"); err != nil {
+		return fmt.Errorf("mount overlay dir: %w", err)
+	}
+	buf := make([]byte, overlayMsgSize)
+	for {
+		n, err := unix.Read(overlayHelperFd, buf)
+		if err != nil {
+			return fmt.Errorf("read overlay request: %w", err)
+		}
+		if n == 0 {
+			// the proxy exited
+			return nil
+		}
+		op, id, _ := strings.Cut(string(buf[:n]), " ")
+		if !sessionIdRe.MatchString(id) {
+			err = fmt.Errorf("invalid session id %q", id)
+		} else if op == "mount" {
+			err = mountOverlay(size, id)
+		} else if op == "unmount" {
+			err = unmountOverlay(id)
+		} else {
+			err = fmt.Errorf("unknown overlay request %q", op)
+		}
+		reply := ""
+		if err != nil {
+			reply = err.Error()
+		}
+		if _, err := unix.Write(overlayHelperFd, []byte(reply)); err != nil {
+			return fmt.Errorf("write overlay reply: %w", err)
+		}
+	}
+}
+
+// overlayClient sends requests to the overlay helper.
+type overlayClient struct {
+	mu sync.Mutex
+	fd int
+}
+
+// newOverlayClient returns a client for the socket with fd passed by
+// startOverlayHelper.
+func newOverlayClient(fd string) (*overlayClient, error) {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("parse overlay fd: %w", err)
+	}
+	// the socket is only for the proxy
+	unix.CloseOnExec(n)
+	return &overlayClient{fd: n}, nil
+}
+
+func (c *overlayClient) request(op string, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := unix.Write(c.fd, []byte(op+" "+id)); err != nil {
+		return fmt.Errorf("overlay %s: %w", op, err)
+	}
+	buf := make([]byte, overlayMsgSize)
+	n, err := unix.Read(c.fd, buf)
+	if err != nil {
+		return fmt.Errorf("overlay %s: %w", op, err)
+	}
+	if n > 0 {
+		return fmt.Errorf("overlay %s: %s", op, buf[:n])
+	}
+	return nil
+}
+
+// setOverlay mounts an overlay for a session and changes a jail config to
+// use it as the root.
+func (p *proxyServer) setOverlay(msg *nsjail.NsJailConfig, s *session) error {
+	// hook.sh can change the mounts, so check that the first is still the root
+	if len(msg.Mount) == 0 || msg.Mount[0].GetDst() != "/" {
+		return errors.New("overlay: first mount of the nsjail config is not the root")
+	}
+	if err := p.overlay.request("mount", s.id); err != nil {
+		return err
+	}
+	root := msg.Mount[0]
+	root.Src = proto.String(overlayRoot(s.id))
+	root.Rw = proto.Bool(true)
+	// the overlay does not include mounts in /srv
+	if _, err := os.Stat("/srv/dev"); err == nil {
+		dev := &nsjail.MountPt{
+			Src:    proto.String("/srv/dev"),
+			Dst:    proto.String("/dev"),
+			IsBind: proto.Bool(true),
+			Nosuid: proto.Bool(true),
+		}
+		msg.Mount = append(msg.Mount[:1], append([]*nsjail.MountPt{dev}, msg.Mount[1:]...)...)
+	}
+	return nil
+}
+
+// removeOverlay unmounts the overlay of a session that has ended.
+func (p *proxyServer) removeOverlay(s *session) {
+	if err := p.overlay.request("unmount", s.id); err != nil {
+		s.log.Error("remove overlay", "err", err)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/redpwn/jail/internal/config"
+	"github.com/redpwn/pow"
+)
+
+const (
+	powPromptPath = "/jail/pow.txt"
+	// approximate difficulty solved per second of CPU time
+	powPerSecond = 1500
+
+	defaultPowPrompt = "proof of work:\ncurl -sSfL https://pwn.red/pow | sh -s {{.Challenge}}\nsolution: "
+)
+
+type powPromptData struct {
+	Challenge  string
+	Difficulty uint32
+	Seconds    int
+}
+
+// powDifficulty returns the difficulty for a new connection from ip.
+func (p *proxyServer) powDifficulty(ip netip.Prefix) uint32 {
+	min, max := float64(p.cfg.Pow), float64(p.cfg.PowMax)
+	if max <= min {
+		return p.cfg.Pow
+	}
+	d := min
+	switch p.cfg.PowAdapt {
+	case "load":
+		p.countMu.Lock()
+		total := p.countTotal
+		p.countMu.Unlock()
+		if p.cfg.Conns > 0 {
+			d = min + (max-min)*float64(total)/float64(p.cfg.Conns)
+		}
+	case "rate":
+		// each recent connection from the same IP doubles the added difficulty
+		d = min + powPerSecond*(math.Pow(2, p.powRates.add(ip)-1)-1)
+	}
+	return uint32(math.Min(d, max))
+}
+
+func loadPowPrompt(cfg *config.Config) (*template.Template, error) {
+	text := defaultPowPrompt
+	if cfg.PowPrompt != "" {
+		text = cfg.PowPrompt
+	}
+	content, err := os.ReadFile(powPromptPath)
+	if err == nil {
+		text = string(content)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read pow prompt: %w", err)
+	}
+	tmpl, err := template.New("pow").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse pow prompt: %w", err)
+	}
+	// fields that do not exist are only found when the template is executed
+	sample := &powPromptData{Challenge: "s.AAAAAQ==.AAAAAAAAAAAAAAAAAAAAAA==", Difficulty: cfg.Pow, Seconds: 1}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("pow prompt: %w", err)
+	}
+	return tmpl, nil
+}
+
+// checkPow prompts for a proof of work and returns any input buffered after
+// the solution.
+func (p *proxyServer) checkPow(conn net.Conn, s *session, difficulty uint32) ([]byte, bool) {
+	start := time.Now()
+	chall := pow.GenerateChallenge(difficulty)
+	if p.cfg.PowMachine {
+		// stable format for automated solvers
+		fmt.Fprintf(conn, "redpwn-pow %s\n", chall)
+	}
+	data := &powPromptData{
+		Challenge:  chall.String(),
+		Difficulty: difficulty,
+		Seconds:    int(math.Ceil(float64(difficulty) / powPerSecond)),
+	}
+	if err := p.powPrompt.Execute(conn, data); err != nil {
+		s.log.Warn("pow prompt", "err", err)
+		return nil, false
+	}
+	if p.cfg.PowTimeout > 0 {
+		conn.SetReadDeadline(start.Add(time.Duration(p.cfg.PowTimeout) * time.Second))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	r := bufio.NewReader(io.LimitReader(conn, 1024)) // prevent DoS
+	proof, err := r.ReadString('\n')
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		s.log.Info("pow timeout")
+		p.metrics.rejected.inc(rejectPowTimeout)
+		conn.Write([]byte("\nproof of work timed out\n"))
+		return nil, false
+	}
+	if err != nil {
+		return nil, false
+	}
+	if good, err := chall.Check(strings.TrimSpace(proof)); err != nil || !good {
+		s.log.Info("bad pow")
+		p.metrics.rejected.inc(rejectBadPow)
+		conn.Write([]byte("incorrect proof of work\n"))
+		return nil, false
+	}
+	solveTime := time.Since(start)
+	s.log.Info("pow solved", "seconds", solveTime.Seconds())
+	p.metrics.powSolve.observe(solveTime)
+	return readBuf(r), true
+}
@@ -2,49 +2,113 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net"
 	"net/netip"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/redpwn/jail/internal/config"
 	"github.com/redpwn/jail/internal/privs"
-	"github.com/redpwn/pow"
+	"github.com/redpwn/jail/internal/proto/nsjail"
 	"golang.org/x/sys/unix"
 )
 
 type proxyServer struct {
-	cfg        *config.Config
-	errCh      chan<- error
-	countMu    sync.Mutex
-	countPerIp map[netip.Addr]uint32
-	countTotal uint32
+	cfg          *config.Config
+	log          *slog.Logger
+	errCh        chan<- error
+	tlsConfig    *tls.Config
+	limiter      *rateLimiter
+	powPrompt    *template.Template
+	powRates     *rateCounter
+	auth         *authenticator
+	acl          atomic.Pointer[acl]
+	nsjailCfg    *nsjail.NsJailConfig
+	overlay      *overlayClient
+	metrics      *metrics
+	listener     net.Listener
+	drainMu      sync.Mutex
+	draining     bool
+	sessions     sync.WaitGroup
+	recordMu     sync.Mutex
+	recording    map[string]bool // session IDs with an open recorder
+	countMu      sync.Mutex
+	countPerIp   map[netip.Prefix]uint32
+	countPerTeam map[string]uint32
+	countTotal   uint32
+	queue        []*queueEntry
 }
 
-func (p *proxyServer) connInc(ip netip.Addr) bool {
+// slot identifies what a connection counts against for concurrency limits.
+type slot struct {
+	ip   netip.Prefix
+	team string
+}
+
+// ipPrefix returns the prefix that ip is grouped into for per-IP limits.
+func (p *proxyServer) ipPrefix(ip netip.Addr) netip.Prefix {
+	bits := p.cfg.Ipv6Prefix
+	if ip.Is4() {
+		bits = p.cfg.Ipv4Prefix
+	}
+	prefix, _ := ip.Prefix(int(bits))
+	return prefix
+}
+
+// totalFull, slotFull and slotInc must be called with countMu held.
+func (p *proxyServer) totalFull() bool {
+	return p.cfg.Conns > 0 && p.countTotal >= p.cfg.Conns
+}
+
+func (p *proxyServer) slotFull(sl slot) bool {
+	if p.cfg.ConnsPerIp > 0 && p.countPerIp[sl.ip] >= p.cfg.ConnsPerIp {
+		return true
+	}
+	return sl.team != "" && p.cfg.ConnsPerTeam > 0 && p.countPerTeam[sl.team] >= p.cfg.ConnsPerTeam
+}
+
+func (p *proxyServer) slotInc(sl slot) {
+	p.countPerIp[sl.ip]++
+	if sl.team != "" {
+		p.countPerTeam[sl.team]++
+	}
+	p.countTotal++
+}
+
+func (p *proxyServer) connInc(sl slot) bool {
 	p.countMu.Lock()
 	defer p.countMu.Unlock()
-	if (p.cfg.Conns > 0 && p.countTotal >= p.cfg.Conns) || (p.cfg.ConnsPerIp > 0 && p.countPerIp[ip] >= p.cfg.ConnsPerIp) {
+	if p.totalFull() || p.slotFull(sl) {
 		return false
 	}
-	p.countPerIp[ip]++
-	p.countTotal++
+	p.slotInc(sl)
 	return true
 }
 
-func (p *proxyServer) connDec(ip netip.Addr) {
+func (p *proxyServer) connDec(sl slot) {
 	p.countMu.Lock()
 	defer p.countMu.Unlock()
-	p.countPerIp[ip]--
-	if p.countPerIp[ip] <= 0 {
-		delete(p.countPerIp, ip)
+	p.countPerIp[sl.ip]--
+	if p.countPerIp[sl.ip] <= 0 {
+		delete(p.countPerIp, sl.ip)
+	}
+	if sl.team != "" {
+		p.countPerTeam[sl.team]--
+		if p.countPerTeam[sl.team] <= 0 {
+			delete(p.countPerTeam, sl.team)
+		}
 	}
 	p.countTotal--
+	p.admitQueued()
 }
 
 // readBuf reads the internal buffer from bufio.Reader
@@ -56,87 +120,349 @@ func readBuf(r *bufio.Reader) []byte {
 	return b
 }
 
-func runCopy(dst io.Writer, src io.Reader, addr *net.TCPAddr, ch chan<- struct{}) {
-	if _, err := io.Copy(dst, src); err != nil && !errors.Is(err, net.ErrClosed) {
-		log.Printf("connection %s: copy: %s", addr, err)
+// session holds the state of one accepted connection.
+type session struct {
+	id   string
+	addr *net.TCPAddr
+	team string
+	log  *slog.Logger
+	// lastActive is the time of the last forwarded read in unix nanoseconds
+	lastActive atomic.Int64
+	// throttle limits both directions of the session, if JAIL_BANDWIDTH is set
+	throttle *throttle
+}
+
+func (p *proxyServer) rateKeys(ip netip.Addr) []netip.Prefix {
+	keys := []netip.Prefix{p.ipPrefix(ip)}
+	if ip.Is6() && p.cfg.RatePrefix > 0 {
+		if prefix, err := ip.Prefix(int(p.cfg.RatePrefix)); err == nil {
+			keys = append(keys, prefix)
+		}
+	}
+	return keys
+}
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+func (p *proxyServer) handshakeTls(conn net.Conn) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, p.tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
 	}
-	ch <- struct{}{}
+	return tlsConn, nil
+}
+
+// fatal reports an error that should stop the server without blocking if
+// another error was already reported.
+func (p *proxyServer) fatal(err error) {
+	select {
+	case p.errCh <- err:
+	default:
+	}
+}
+
+// drainConn sends the drain message to a client that connected while the
+// proxy is draining. It is not a session, so it does not delay the drain.
+func (p *proxyServer) drainConn(conn net.Conn) {
+	defer conn.Close()
+	peer := conn.RemoteAddr().String()
+	if p.cfg.ProxyProto {
+		if _, err := readProxyHeader(conn); err != nil {
+			return
+		}
+	}
+	if p.tlsConfig != nil {
+		tlsConn, err := p.handshakeTls(conn)
+		if err != nil {
+			return
+		}
+		defer tlsConn.Close()
+		conn = tlsConn
+	}
+	p.log.Info("draining", "peer", peer)
+	fmt.Fprintln(conn, p.cfg.DrainMessage)
 }
 
 func (p *proxyServer) runConn(inConn net.Conn) {
+	defer p.sessions.Done()
 	defer inConn.Close()
 	addr := inConn.RemoteAddr().(*net.TCPAddr)
-	log.Printf("connection %s: connect", addr)
-	defer log.Printf("connection %s: close", addr)
+	s := &session{id: newSessionId()}
+	s.log = p.log.With("session", s.id)
+	if p.cfg.ProxyProto {
+		proxyAddr, err := readProxyHeader(inConn)
+		if err != nil {
+			s.log.Info("proxy protocol", "peer", addr.String(), "err", err)
+			return
+		}
+		if proxyAddr != nil {
+			addr = proxyAddr
+		}
+	}
+	s.addr = addr
+	s.log = s.log.With("addr", addr.String())
+	s.log.Info("connect")
+	defer s.log.Info("close")
 	ip, ok := netip.AddrFromSlice(addr.IP)
 	if !ok {
 		return
 	}
-
-	if !p.connInc(ip) {
-		log.Printf("connection %s: limit reached", addr)
+	ip = ip.Unmap()
+	prefix := p.ipPrefix(ip)
+	if a := p.acl.Load(); a != nil && !a.permits(ip) {
+		s.log.Info("denied")
+		p.metrics.rejected.inc(rejectDenied)
 		return
 	}
-	defer p.connDec(ip)
 
-	chall := pow.GenerateChallenge(p.cfg.Pow)
-	fmt.Fprintf(inConn, "proof of work:\ncurl -sSfL https://pwn.red/pow | sh -s %s\nsolution: ", chall)
-	r := bufio.NewReader(io.LimitReader(inConn, 1024)) // prevent DoS
-	proof, err := r.ReadString('\n')
+	if p.tlsConfig != nil {
+		tlsConn, err := p.handshakeTls(inConn)
+		if err != nil {
+			s.log.Info("tls handshake", "err", err)
+			return
+		}
+		defer tlsConn.Close()
+		inConn = tlsConn
+	}
+
+	if p.limiter != nil {
+		if ok, wait := p.limiter.allow(p.rateKeys(ip)...); !ok {
+			s.log.Info("rate limited")
+			p.metrics.rejected.inc(rejectRateLimit)
+			fmt.Fprintf(inConn, "too many connections, try again in %d seconds\n", int(math.Ceil(wait.Seconds())))
+			return
+		}
+	}
+
+	sl := slot{ip: prefix}
+	if p.auth != nil {
+		team, ok := p.checkAuth(inConn, s)
+		if !ok {
+			return
+		}
+		sl.team = team
+	}
+
+	acquire := func() bool {
+		return p.connInc(sl) || p.waitQueue(inConn, s, sl)
+	}
+	if !p.cfg.PowFirst {
+		if !acquire() {
+			return
+		}
+		defer p.connDec(sl)
+	}
+
+	var buf []byte
+	if p.cfg.PowEnabled() {
+		difficulty := p.powDifficulty(prefix)
+		s.log.Info("pow", "difficulty", difficulty)
+		if difficulty > 0 {
+			if buf, ok = p.checkPow(inConn, s, difficulty); !ok {
+				return
+			}
+		}
+	}
+
+	if p.cfg.PowFirst {
+		if !acquire() {
+			return
+		}
+		defer p.connDec(sl)
+	}
+
+	var outConn jail
+	var err error
+	if p.cfg.Once() {
+		f := p.directFile(inConn, buf)
+		outConn, err = p.startJail(s, f)
+		if f != nil {
+			f.Close()
+		}
+	} else {
+		outConn, err = p.dialJail(s)
+	}
 	if err != nil {
+		p.metrics.rejected.inc(rejectDial)
+		if !p.cfg.Once() {
+			// the nsjail listener is gone, so no session can succeed
+			p.fatal(err)
+			return
+		}
+		// failures of one jail do not affect other sessions
+		s.log.Error("start jail", "err", err)
+		fmt.Fprintln(inConn, "failed to start, try again later")
 		return
 	}
-	if good, err := chall.Check(strings.TrimSpace(proof)); err != nil || !good {
-		log.Printf("connection %s: bad pow", addr)
-		inConn.Write([]byte("incorrect proof of work\n"))
+	defer outConn.Close()
+	p.metrics.accepted.Add(1)
+	start := time.Now()
+	defer func() { p.metrics.sessionDur.observe(time.Since(start)) }()
+	if j, ok := outConn.(*onceJail); ok && j.direct() {
+		<-j.done
 		return
 	}
+	var rec *recorder
+	if p.cfg.Record() {
+		if rec, err = p.newRecorder(s); err != nil {
+			s.log.Error("record", "err", err)
+		} else {
+			defer rec.Close()
+			if len(buf) > 0 {
+				rec.record(recordIn, buf)
+			}
+		}
+	}
+	outConn.Write(buf)
+	s.lastActive.Store(time.Now().UnixNano())
+	// buffered so the goroutines that lose can still send
+	endCh := make(chan string, 3)
+	done := make(chan struct{})
+	defer close(done)
+	if p.cfg.Bandwidth > 0 {
+		s.throttle = newThrottle(uint64(p.cfg.Bandwidth))
+	}
+	in, out := p.directions(rec)
+	go p.runCopy(inConn, outConn, s, out, endCh)
+	go p.runCopy(outConn, inConn, s, in, endCh)
+	if p.cfg.IdleTimeout > 0 {
+		go p.watchIdle(s, endCh, done)
+	}
+	if reason := p.waitCopy(s, endCh); reason != "" {
+		s.log.Info("terminated", "reason", reason)
+		fmt.Fprintf(inConn, "\nsession terminated: %s\n", reason)
+	}
+}
 
-	log.Printf("connection %s: forwarding", addr)
-	port, _ := p.cfg.NsjailListen()
-	outConn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+func loadTls(cfg *config.Config) (*tls.Config, error) {
+	if !cfg.Tls() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TlsCert, cfg.TlsKey)
 	if err != nil {
-		p.errCh <- err
-		return
+		return nil, fmt.Errorf("load tls key pair: %w", err)
 	}
-	defer outConn.Close()
-	outConn.Write(readBuf(r))
-	eofCh := make(chan struct{})
-	go runCopy(inConn, outConn, addr, eofCh)
-	go runCopy(outConn, inConn, addr, eofCh)
-	<-eofCh
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
 }
 
-func startProxy(cfg *config.Config, errCh chan<- error) {
+func newProxyServer(cfg *config.Config, logger *slog.Logger, errCh chan<- error) (*proxyServer, error) {
+	tlsConfig, err := loadTls(cfg)
+	if err != nil {
+		return nil, err
+	}
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
 	if err != nil {
-		errCh <- err
-		return
+		return nil, err
+	}
+	logger.Info("listening", "port", cfg.Port)
+	if reason := cfg.OnceReason(); reason != "" {
+		logger.Info("once mode", "set_by", reason)
 	}
-	log.Printf("listening on %d", cfg.Port)
-	defer l.Close()
 	p := &proxyServer{
-		cfg:        cfg,
-		errCh:      errCh,
-		countPerIp: make(map[netip.Addr]uint32),
+		cfg:          cfg,
+		log:          logger,
+		errCh:        errCh,
+		tlsConfig:    tlsConfig,
+		recording:    make(map[string]bool),
+		countPerIp:   make(map[netip.Prefix]uint32),
+		countPerTeam: make(map[string]uint32),
+		metrics:      newMetrics(),
+		listener:     l,
+	}
+	if p.auth, err = loadAuth(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Acl {
+		a, err := loadAcl()
+		if err != nil {
+			return nil, err
+		}
+		p.acl.Store(a)
+	}
+	if cfg.Once() {
+		if p.nsjailCfg, err = config.ReadConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Rate > 0 {
+		p.limiter = newRateLimiter(cfg.Rate, cfg.RateBurst)
+	}
+	if cfg.PowEnabled() {
+		if p.powPrompt, err = loadPowPrompt(cfg); err != nil {
+			return nil, err
+		}
+		p.powRates = newRateCounter()
+	}
+	return p, nil
+}
+
+func (p *proxyServer) serve() {
+	if p.cfg.MetricsPort > 0 {
+		go p.startMetrics()
+	}
+	if p.cfg.Acl {
+		go p.watchAcl()
+	}
+	if p.cfg.Record() {
+		go p.watchRecordings()
 	}
 	for {
-		conn, err := l.Accept()
+		conn, err := p.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			log.Println(err)
+			p.log.Error("accept", "err", err)
 			continue
 		}
+		// sessions must not be added after drain starts waiting for them
+		p.drainMu.Lock()
+		if p.draining {
+			p.drainMu.Unlock()
+			go p.drainConn(conn)
+			continue
+		}
+		p.sessions.Add(1)
+		p.drainMu.Unlock()
 		go p.runConn(conn)
 	}
 }
 
+// drain stops new sessions and waits up to timeout for existing sessions to
+// end. If a drain message is configured, new clients are sent the message
+// instead of being refused.
+func (p *proxyServer) drain(timeout time.Duration) {
+	p.drainMu.Lock()
+	p.draining = true
+	p.drainMu.Unlock()
+	if p.cfg.DrainMessage == "" {
+		p.listener.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		p.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		p.log.Info("drained")
+	case <-time.After(timeout):
+		p.log.Warn("drain timeout")
+	}
+}
+
 const runPath = "/jail/run"
 
-func execProxy(cfg *config.Config) error {
+func execProxy(cfg *config.Config, args ...string) error {
 	if err := privs.DropPrivs(cfg); err != nil {
 		return err
 	}
-	if err := unix.Exec(runPath, []string{runPath, "proxy"}, os.Environ()); err != nil {
+	if err := unix.Exec(runPath, append([]string{runPath, "proxy"}, args...), os.Environ()); err != nil {
 		return fmt.Errorf("exec run: %w", err)
 	}
 	return nil
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+
+const (
+	proxyHeaderTimeout = 10 * time.Second
+	proxyV1MaxLen      = 107
+)
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+func readProxyV1(conn net.Conn) (*net.TCPAddr, error) {
+	line := append([]byte{}, proxyV1Prefix...)
+	b := make([]byte, 1)
+	// read one byte at a time so no data after the header is consumed
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("v1 header too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("bad v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad v1 source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(conn net.Conn) (*net.TCPAddr, error) {
+	// the first len(proxyV1Prefix) bytes of the signature were already read
+	hdr := make([]byte, 16-len(proxyV1Prefix))
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:len(proxyV2Sig)-len(proxyV1Prefix)], proxyV2Sig[len(proxyV1Prefix):]) {
+		return nil, errors.New("bad v2 signature")
+	}
+	verCmd, fam := hdr[6], hdr[7]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[8:10]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	switch verCmd & 0xf {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", verCmd&0xf)
+	}
+	switch fam {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short v2 ipv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 ipv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// unspecified or non-tcp families: use the socket address
+	return nil, nil
+}
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from conn and
+// returns the client address it describes. A nil address means the header
+// did not carry one and the socket address should be used.
+func readProxyHeader(conn net.Conn) (*net.TCPAddr, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	prefix := make([]byte, len(proxyV1Prefix))
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(conn)
+	}
+	if bytes.Equal(prefix, proxyV2Sig[:len(prefix)]) {
+		return readProxyV2(conn)
+	}
+	return nil, errors.New("missing header")
+}
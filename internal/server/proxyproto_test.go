@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// proxyV2 returns a v2 header with the given command, family, and address
+// block.
+func proxyV2(cmd byte, fam byte, block []byte) []byte {
+	hdr := append([]byte{}, proxyV2Sig...)
+	hdr = append(hdr, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:16], uint16(len(block)))
+	return append(hdr, block...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4Block := []byte{
+		192, 0, 2, 1, // source
+		198, 51, 100, 1, // destination
+		0x30, 0x39, // source port 12345
+		0x01, 0xbb, // destination port 443
+	}
+	v6Block := make([]byte, 36)
+	v6Block[0], v6Block[1], v6Block[15] = 0x20, 0x01, 0x01
+	binary.BigEndian.PutUint16(v6Block[32:34], 12345)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		addr    string
+		wantErr bool
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n"), addr: "192.0.2.1:12345"},
+		{name: "v1 tcp6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), addr: "[2001:db8::1]:12345"},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 unknown with addresses", header: []byte("PROXY UNKNOWN 192.0.2.1 198.51.100.1 12345 443\r\n")},
+		{name: "v1 family mismatch", header: []byte("PROXY TCP4 2001:db8::1 2001:db8::2 12345 443\r\n"), wantErr: true},
+		{name: "v1 bad port", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 123456 443\r\n"), wantErr: true},
+		{name: "v1 too long", header: []byte("PROXY TCP6 " + string(make([]byte, 120)) + "\r\n"), wantErr: true},
+		{name: "v2 proxy ipv4", header: proxyV2(0x1, 0x11, v4Block), addr: "192.0.2.1:12345"},
+		{name: "v2 proxy ipv6", header: proxyV2(0x1, 0x21, v6Block), addr: "[2001::1]:12345"},
+		{name: "v2 proxy with tlvs", header: proxyV2(0x1, 0x11, append(append([]byte{}, v4Block...), 0x04, 0, 1, 'x')), addr: "192.0.2.1:12345"},
+		{name: "v2 local", header: proxyV2(0x0, 0x00, nil)},
+		{name: "v2 unspecified family", header: proxyV2(0x1, 0x00, nil)},
+		{name: "v2 short ipv4 block", header: proxyV2(0x1, 0x11, v4Block[:8]), wantErr: true},
+		{name: "v2 short ipv6 block", header: proxyV2(0x1, 0x21, v6Block[:20]), wantErr: true},
+		{name: "v2 bad version", header: append(append([]byte{}, proxyV2Sig...), 0x11, 0x11, 0, 0), wantErr: true},
+		{name: "v2 bad command", header: proxyV2(0x2, 0x11, v4Block), wantErr: true},
+		{name: "missing header", header: []byte("GET / HTTP/1.1\r\n"), wantErr: true},
+	}
+	const rest = "data after the header"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(tt.header)
+				client.Write([]byte(rest))
+				client.Close()
+			}()
+			addr, err := readProxyHeader(server)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got address %v, want error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.addr == "" && addr != nil {
+				t.Errorf("got address %v, want nil", addr)
+			} else if tt.addr != "" && (addr == nil || addr.String() != tt.addr) {
+				t.Errorf("got address %v, want %s", addr, tt.addr)
+			}
+			got, err := io.ReadAll(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != rest {
+				t.Errorf("got %q after the header, want %q", got, rest)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const queueUpdateInterval = 10 * time.Second
+
+type queueEntry struct {
+	slot  slot
+	ready chan struct{}
+}
+
+// admitQueued gives free slots to queued connections in order, skipping
+// connections from IPs or teams that are at their limit. It must be called
+// with countMu held.
+func (p *proxyServer) admitQueued() {
+	for i := 0; i < len(p.queue) && !p.totalFull(); {
+		e := p.queue[i]
+		if p.slotFull(e.slot) {
+			i++
+			continue
+		}
+		p.slotInc(e.slot)
+		close(e.ready)
+		p.queue = append(p.queue[:i], p.queue[i+1:]...)
+	}
+}
+
+// queuePos returns the 1-based position of e in the queue, or 0 if e is not
+// queued. It must be called with countMu held.
+func (p *proxyServer) queuePos(e *queueEntry) int {
+	for i, q := range p.queue {
+		if q == e {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// enqueue adds a connection that did not get a slot to the queue. If a slot
+// was freed in the meantime, the connection is admitted immediately. It
+// returns nil if the connection may not wait.
+func (p *proxyServer) enqueue(sl slot) *queueEntry {
+	p.countMu.Lock()
+	defer p.countMu.Unlock()
+	e := &queueEntry{slot: sl, ready: make(chan struct{})}
+	if p.slotFull(sl) {
+		return nil
+	}
+	if !p.totalFull() {
+		p.slotInc(sl)
+		close(e.ready)
+		return e
+	}
+	if p.cfg.Queue <= 0 || uint32(len(p.queue)) >= p.cfg.Queue {
+		return nil
+	}
+	if p.cfg.QueuePerIp > 0 {
+		queued := uint32(0)
+		for _, q := range p.queue {
+			if q.slot.ip == sl.ip {
+				queued++
+			}
+		}
+		if queued >= p.cfg.QueuePerIp {
+			return nil
+		}
+	}
+	p.queue = append(p.queue, e)
+	return e
+}
+
+// leaveQueue removes e from the queue. It returns whether e was already
+// admitted, in which case the connection holds a slot.
+func (p *proxyServer) leaveQueue(e *queueEntry) bool {
+	p.countMu.Lock()
+	defer p.countMu.Unlock()
+	if i := p.queuePos(e); i > 0 {
+		p.queue = append(p.queue[:i-1], p.queue[i:]...)
+		return false
+	}
+	return true
+}
+
+// waitQueue holds a connection that did not get a slot in the queue until a
+// slot is free. It returns whether the connection was given a slot.
+func (p *proxyServer) waitQueue(conn net.Conn, s *session, sl slot) bool {
+	e := p.enqueue(sl)
+	if e == nil {
+		s.log.Info("limit reached")
+		p.metrics.rejected.inc(rejectLimit)
+		fmt.Fprintln(conn, "too many connections, try again later")
+		return false
+	}
+	var timeout <-chan time.Time
+	if p.cfg.QueueTime > 0 {
+		timer := time.NewTimer(time.Duration(p.cfg.QueueTime) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	ticker := time.NewTicker(queueUpdateInterval)
+	defer ticker.Stop()
+	update := true
+	for {
+		if update {
+			p.countMu.Lock()
+			pos := p.queuePos(e)
+			p.countMu.Unlock()
+			if pos > 0 {
+				s.log.Info("queued", "position", pos)
+				if _, err := fmt.Fprintf(conn, "server is full, you are number %d in the queue\n", pos); err != nil {
+					return p.leaveQueue(e)
+				}
+			}
+			update = false
+		}
+		select {
+		case <-e.ready:
+			return true
+		case <-ticker.C:
+			update = true
+		case <-timeout:
+			if p.leaveQueue(e) {
+				return true
+			}
+			s.log.Info("queue timeout")
+			p.metrics.rejected.inc(rejectQueueTimeout)
+			fmt.Fprintln(conn, "sorry, the server is still full, try again later")
+			return false
+		}
+	}
+}
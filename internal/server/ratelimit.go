@@ -0,0 +1,125 @@
+package server
+
+import (
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const rateSweepInterval = time.Minute
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter keyed by client prefix.
+type rateLimiter struct {
+	rate      float64 // tokens per second
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[netip.Prefix]*rateBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(perMinute uint32, burst uint32) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[netip.Prefix]*rateBucket),
+	}
+}
+
+func (l *rateLimiter) refill(key netip.Prefix, now time.Time) *rateBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// sweep removes full buckets, which are indistinguishable from new buckets.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// allow takes a token from the bucket of every key. If any bucket is empty,
+// nothing is taken and allow returns the time until a token is available.
+func (l *rateLimiter) allow(keys ...netip.Prefix) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	buckets := make([]*rateBucket, len(keys))
+	wait := time.Duration(0)
+	for i, key := range keys {
+		buckets[i] = l.refill(key, now)
+		if buckets[i].tokens < 1 {
+			keyWait := time.Duration((1 - buckets[i].tokens) / l.rate * float64(time.Second))
+			if keyWait > wait {
+				wait = keyWait
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// rateCounter estimates recent connections per minute for each client prefix
+// with an exponentially decaying count.
+type rateCounter struct {
+	mu        sync.Mutex
+	counts    map[netip.Prefix]*rateBucket
+	lastSweep time.Time
+}
+
+func newRateCounter() *rateCounter {
+	return &rateCounter{counts: make(map[netip.Prefix]*rateBucket)}
+}
+
+func decay(b *rateBucket, now time.Time) float64 {
+	return b.tokens * math.Exp(-now.Sub(b.last).Minutes())
+}
+
+// add records a connection and returns the recent count including it.
+func (c *rateCounter) add(key netip.Prefix) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) >= rateSweepInterval {
+		c.lastSweep = now
+		for k, b := range c.counts {
+			if decay(b, now) < 0.01 {
+				delete(c.counts, k)
+			}
+		}
+	}
+	b, ok := c.counts[key]
+	if !ok {
+		b = &rateBucket{last: now}
+		c.counts[key] = b
+	}
+	b.tokens = decay(b, now) + 1
+	b.last = now
+	return b.tokens
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	recordMagic         = "JAILREC1"
+	recordExt           = ".rec"
+	recordHeaderSize    = 8 + 1 + 4
+	recordSweepInterval = time.Minute
+)
+
+// record kinds
+const (
+	recordIn        = 'i'
+	recordOut       = 'o'
+	recordTruncated = 't'
+)
+
+// recorder writes the data of one session to a transcript file.
+//
+// The file starts with recordMagic and the session start time in Unix
+// nanoseconds. Each record is the time since the start in nanoseconds, a kind
+// byte, and the data length, followed by the data. Integers are big-endian,
+// with 8 bytes for times and 4 bytes for lengths. Once the size limit is
+// reached, a truncated record with no data is written and recording stops.
+//
+// Each record is written to the file as it happens, so a transcript is
+// complete up to a crash and its modification time shows that it is in use.
+type recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	p     *proxyServer
+	id    string
+	start time.Time
+	size  uint64
+	max   uint64
+	done  bool
+	err   error
+}
+
+func (p *proxyServer) newRecorder(s *session) (*recorder, error) {
+	path := filepath.Join(p.cfg.RecordDir, s.id+recordExt)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("create recording: %w", err)
+	}
+	r := &recorder{
+		f:     f,
+		p:     p,
+		id:    s.id,
+		start: time.Now(),
+		max:   uint64(p.cfg.RecordSize),
+	}
+	p.recordMu.Lock()
+	p.recording[s.id] = true
+	p.recordMu.Unlock()
+	r.write(binary.BigEndian.AppendUint64([]byte(recordMagic), uint64(r.start.UnixNano())))
+	return r, nil
+}
+
+// write writes b to the file. After an error, nothing more is written, and
+// the error is returned by Close.
+func (r *recorder) write(b []byte) {
+	if r.err != nil {
+		return
+	}
+	if _, err := r.f.Write(b); err != nil {
+		r.err = err
+		r.done = true
+		return
+	}
+	r.size += uint64(len(b))
+}
+
+func (r *recorder) writeRecord(kind byte, data []byte) {
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint64(buf[:8], uint64(time.Since(r.start)))
+	buf[8] = kind
+	binary.BigEndian.PutUint32(buf[9:], uint32(len(data)))
+	r.write(append(buf, data...))
+}
+
+// record adds data sent in the direction given by kind.
+func (r *recorder) record(kind byte, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+	if r.max > 0 && r.size+uint64(len(data))+2*recordHeaderSize > r.max {
+		r.writeRecord(recordTruncated, nil)
+		r.done = true
+		return
+	}
+	r.writeRecord(kind, data)
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = true
+	r.p.recordMu.Lock()
+	delete(r.p.recording, r.id)
+	r.p.recordMu.Unlock()
+	if err := r.f.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+// sweepRecordings removes recordings older than the maximum age, then the
+// oldest recordings until the total size is within the limit. Recordings of
+// sessions that are still open are never removed.
+func (p *proxyServer) sweepRecordings() error {
+	entries, err := os.ReadDir(p.cfg.RecordDir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	total := uint64(0)
+	now := time.Now()
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasSuffix(e.Name(), recordExt) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		total += uint64(info.Size())
+		p.recordMu.Lock()
+		live := p.recording[strings.TrimSuffix(e.Name(), recordExt)]
+		p.recordMu.Unlock()
+		if live {
+			continue
+		}
+		if p.cfg.RecordAge > 0 && now.Sub(info.ModTime()) > time.Duration(p.cfg.RecordAge)*time.Second {
+			os.Remove(filepath.Join(p.cfg.RecordDir, info.Name()))
+			total -= uint64(info.Size())
+			continue
+		}
+		files = append(files, info)
+	}
+	if p.cfg.RecordTotal == 0 {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, info := range files {
+		if total <= uint64(p.cfg.RecordTotal) {
+			break
+		}
+		if err := os.Remove(filepath.Join(p.cfg.RecordDir, info.Name())); err != nil {
+			return err
+		}
+		total -= uint64(info.Size())
+	}
+	return nil
+}
+
+func (p *proxyServer) watchRecordings() {
+	if p.cfg.RecordAge == 0 && p.cfg.RecordTotal == 0 {
+		return
+	}
+	ticker := time.NewTicker(recordSweepInterval)
+	defer ticker.Stop()
+	for {
+		if err := p.sweepRecordings(); err != nil {
+			p.log.Error("sweep recordings", "err", err)
+		}
+		<-ticker.C
+	}
+}
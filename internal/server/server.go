@@ -1,19 +1,68 @@
 package server
 
 import (
+	"errors"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
 	"github.com/redpwn/jail/internal/config"
+	"golang.org/x/sys/unix"
 )
 
-func RunProxy(cfg *config.Config) error {
-	errCh := make(chan error)
-	go runNsjailChild(errCh)
-	go startProxy(cfg, errCh)
-	return <-errCh
+// RunProxy runs the proxy. If the jail root is an overlay, args is the fd of
+// the socket to the overlay helper.
+func RunProxy(cfg *config.Config, args []string) error {
+	logger, err := newLogger(cfg)
+	if err != nil {
+		return err
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, unix.SIGTERM, unix.SIGINT)
+	errCh := make(chan error, 1)
+	var child *nsjailChild
+	if !cfg.Once() {
+		if child, err = startNsjailChild(errCh); err != nil {
+			return err
+		}
+	}
+	p, err := newProxyServer(cfg, logger, errCh)
+	if err != nil {
+		return err
+	}
+	if cfg.Overlay() {
+		if len(args) != 1 {
+			return errors.New("usage: jailrun proxy <overlay fd>")
+		}
+		if p.overlay, err = newOverlayClient(args[0]); err != nil {
+			return err
+		}
+	}
+	go p.serve()
+	select {
+	case err := <-errCh:
+		return err
+	case sig := <-sigCh:
+		logger.Info("shutting down", "signal", sig.String())
+	}
+	p.drain(time.Duration(cfg.DrainTimeout) * time.Second)
+	if child == nil {
+		return nil
+	}
+	return child.stop()
 }
 
 func ExecServer(cfg *config.Config) error {
 	_, proxy := cfg.NsjailListen()
 	if proxy {
+		if cfg.Overlay() {
+			fd, err := startOverlayHelper(cfg)
+			if err != nil {
+				return err
+			}
+			return execProxy(cfg, strconv.Itoa(fd))
+		}
 		return execProxy(cfg)
 	}
 	return execNsjail(cfg)
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceSize is the most data moved by one splice, which is the default pipe
+// capacity.
+const spliceSize = 64 * 1024
+
+// rawConn returns the raw connection of v if data can be spliced to or from
+// it. The stdio of a jail started by startJail is two pipes, so write selects
+// which one is returned.
+func rawConn(v any, write bool) (syscall.RawConn, bool) {
+	if j, ok := v.(*onceJail); ok {
+		if write {
+			v = j.stdin
+		} else {
+			v = j.stdout
+		}
+	}
+	sc, ok := v.(syscall.Conn)
+	if !ok {
+		return nil, false
+	}
+	rc, err := sc.SyscallConn()
+	return rc, err == nil
+}
+
+// spliceConns returns the raw connections of dst and src if the direction can
+// be forwarded with splice, which is when neither end is TLS and no data needs
+// to pass through the proxy for recording or throttling.
+func (p *proxyServer) spliceConns(dst io.Writer, src io.Reader, d *direction) (syscall.RawConn, syscall.RawConn, bool) {
+	if d.rec != nil || p.cfg.Bandwidth > 0 {
+		return nil, nil, false
+	}
+	rdst, ok := rawConn(dst, true)
+	if !ok {
+		return nil, nil, false
+	}
+	rsrc, ok := rawConn(src, false)
+	if !ok {
+		return nil, nil, false
+	}
+	return rdst, rsrc, true
+}
+
+// tcpConns returns dst and src if both are TCP connections and no limit needs
+// to see each read, so that the direction can be forwarded with tcpCopy.
+func (p *proxyServer) tcpConns(dst io.Writer, src io.Reader, d *direction) (*net.TCPConn, *net.TCPConn, bool) {
+	if d.rec != nil || p.cfg.Bandwidth > 0 || d.maxBytes > 0 || p.cfg.IdleTimeout > 0 {
+		return nil, nil, false
+	}
+	tdst, ok := dst.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	tsrc, ok := src.(*net.TCPConn)
+	return tdst, tsrc, ok
+}
+
+// tcpCopy copies src to dst with TCPConn.ReadFrom, which splices through a
+// larger, pooled pipe and is faster than spliceCopy between TCP connections.
+// Bytes are counted when the copy ends.
+func tcpCopy(dst *net.TCPConn, src *net.TCPConn, d *direction) error {
+	n, err := dst.ReadFrom(src)
+	d.count.Add(uint64(n))
+	if err == nil {
+		return io.EOF
+	}
+	return err
+}
+
+// splice moves up to n bytes from the fd of c to fd, waiting until c is ready.
+// If fromC is false, data moves from fd to c instead.
+func splice(c syscall.RawConn, fd int, n int, fromC bool) (int, error) {
+	var moved int64
+	var serr error
+	f := func(cfd uintptr) bool {
+		in, out := int(cfd), fd
+		if !fromC {
+			in, out = fd, int(cfd)
+		}
+		moved, serr = unix.Splice(in, nil, out, nil, n, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+		return serr != unix.EAGAIN
+	}
+	var err error
+	if fromC {
+		err = c.Read(f)
+	} else {
+		err = c.Write(f)
+	}
+	if err != nil {
+		// no deadlines are set while copying, so c was closed, but closed
+		// files return an error from internal/poll here
+		return 0, os.ErrClosed
+	}
+	if serr != nil {
+		return 0, os.NewSyscallError("splice", serr)
+	}
+	return int(moved), nil
+}
+
+// spliceCopy copies src to dst through a pipe with splice, so that data is
+// not copied to the proxy. It applies the same limits as bufferedCopy, except
+// for bandwidth.
+func spliceCopy(dst syscall.RawConn, src syscall.RawConn, s *session, d *direction) error {
+	var pipe [2]int
+	if err := unix.Pipe2(pipe[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return os.NewSyscallError("pipe2", err)
+	}
+	defer unix.Close(pipe[0])
+	defer unix.Close(pipe[1])
+	total := uint64(0)
+	for {
+		size := spliceSize
+		if d.maxBytes > 0 {
+			// read one byte past the limit to tell if it was exceeded
+			size = int(min(uint64(size), d.maxBytes-total+1))
+		}
+		n, err := splice(src, pipe[1], size, true)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.EOF
+		}
+		s.lastActive.Store(time.Now().UnixNano())
+		if d.maxBytes > 0 && total+uint64(n) > d.maxBytes {
+			n = int(d.maxBytes - total)
+			err = errMaxBytes
+		}
+		// the pipe is empty before each read, so everything read is written
+		for left := n; left > 0; {
+			m, werr := splice(dst, pipe[0], left, false)
+			if werr != nil {
+				return werr
+			}
+			left -= m
+		}
+		total += uint64(n)
+		d.count.Add(uint64(n))
+		if err != nil {
+			return err
+		}
+	}
+}